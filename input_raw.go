@@ -0,0 +1,101 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"unicode/utf8"
+
+	tb "github.com/nsf/termbox-go"
+)
+
+// enableTerminalReports asks the terminal to wrap pasted text in
+// PASTE_START/PASTE_END, and to tell us when it gets the focus back, to
+// look for changes made to open files meanwhile
+func enableTerminalReports() {
+	os.Stdout.WriteString(BRACKETED_PASTE_ON)
+	os.Stdout.WriteString(FOCUS_REPORTING_ON)
+}
+
+// disableTerminalReports undoes enableTerminalReports
+func disableTerminalReports() {
+	os.Stdout.WriteString(FOCUS_REPORTING_OFF)
+	os.Stdout.WriteString(BRACKETED_PASTE_OFF)
+}
+
+var (
+	inputBuf []byte // raw input not yet turned into events
+	rawBuf   = make([]byte, 4096)
+)
+
+// editorReadEvent waits for the next event. termbox knows nothing
+// about bracketed paste, so we read raw bytes and parse them ourselves
+// with the help of tb.ParseEvent.
+func editorReadEvent() editorEvent {
+	for {
+		if ev, n := parseInput(inputBuf); n > 0 {
+			inputBuf = inputBuf[n:]
+			if ev.Type != tb.EventNone {
+				return ev
+			}
+			// bytes termbox can't recognize, skip them
+			continue
+		}
+		ev := tb.PollRawEvent(rawBuf)
+		if ev.Type == tb.EventInterrupt {
+			editorInterrupted()
+		}
+		if ev.Type != tb.EventRaw {
+			return editorEvent{Event: ev}
+		}
+		inputBuf = append(inputBuf, rawBuf[:ev.N]...)
+	}
+}
+
+// parseInput parses the first event in buf and returns it along with
+// the number of bytes it used. 0 means more input is needed.
+func parseInput(buf []byte) (editorEvent, int) {
+	if len(buf) == 0 {
+		return editorEvent{}, 0
+	}
+	// in InputAlt mode termbox waits for the key after ESC, but a
+	// lone ESC is the Esc key
+	if len(buf) == 1 && buf[0] == '\x1b' {
+		return editorEvent{Event: tb.Event{Type: tb.EventKey, Key: tb.KeyEsc, N: 1}}, 1
+	}
+	if bytes.HasPrefix(buf, []byte(FOCUS_IN)) {
+		return editorEvent{Event: tb.Event{Type: EventFocus}}, len(FOCUS_IN)
+	}
+	if bytes.HasPrefix(buf, []byte(FOCUS_OUT)) {
+		return editorEvent{Event: tb.Event{Type: tb.EventNone}}, len(FOCUS_OUT)
+	}
+	if bytes.HasPrefix(buf, []byte(PASTE_START)) {
+		text := buf[len(PASTE_START):]
+		end := bytes.Index(text, []byte(PASTE_END))
+		if end < 0 { // the paste is still coming
+			return editorEvent{}, 0
+		}
+		ev := editorEvent{
+			Event: tb.Event{Type: EventPaste},
+			paste: []rune(string(text[:end])),
+		}
+		return ev, len(PASTE_START) + end + len(PASTE_END)
+	}
+	// a partially read PASTE_START, "\x1b[" alone may be M-[ so
+	// don't wait on that
+	if len(buf) > 2 && bytes.HasPrefix([]byte(PASTE_START), buf) {
+		return editorEvent{}, 0
+	}
+	ev := tb.ParseEvent(buf)
+	// termbox makes nothing of an invalid UTF-8 byte or of a literal
+	// U+FFFD, which would then block everything after it
+	if ev.N == 0 && buf[0] != '\x1b' && utf8.FullRune(buf) {
+		r, size := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && size == 1 {
+			return editorEvent{Event: tb.Event{Type: tb.EventNone, N: 1}}, 1
+		}
+		return editorEvent{Event: tb.Event{Type: tb.EventKey, Ch: r, N: size}}, size
+	}
+	return editorEvent{Event: ev}, ev.N
+}
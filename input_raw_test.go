@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"testing"
+
+	tb "github.com/nsf/termbox-go"
+)
+
+func TestParseInputPaste(t *testing.T) {
+	buf := []byte(PASTE_START + "a\x1bb\rc" + PASTE_END + "x")
+	ev, n := parseInput(buf)
+	if ev.Type != EventPaste || string(ev.paste) != "a\x1bb\rc" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	ev, _ = parseInput(buf[n:])
+	if ev.Type != tb.EventKey || ev.Ch != 'x' {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	// paste not finished yet
+	if _, n := parseInput(buf[:len(PASTE_START)+2]); n != 0 {
+		t.Fatalf("expected to wait for more input, got n = %d", n)
+	}
+}
+
+func TestParseInputInvalidUTF8(t *testing.T) {
+	buf := []byte("\xff a\uFFFD")
+	var keys []rune
+	for len(buf) > 0 {
+		ev, n := parseInput(buf)
+		if n == 0 {
+			t.Fatalf("stuck at %q", buf)
+		}
+		buf = buf[n:]
+		if ev.Type == tb.EventKey {
+			keys = append(keys, ev.Ch)
+			if ev.Key == tb.KeySpace {
+				keys[len(keys)-1] = ' '
+			}
+		}
+	}
+	if string(keys) != " a\uFFFD" {
+		t.Fatalf("unexpected keys: %q", string(keys))
+	}
+}
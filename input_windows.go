@@ -0,0 +1,20 @@
+package main
+
+import tb "github.com/nsf/termbox-go"
+
+// enableTerminalReports does nothing, the windows console reports
+// neither pastes nor focus changes
+func enableTerminalReports() {}
+
+// disableTerminalReports does nothing, see enableTerminalReports
+func disableTerminalReports() {}
+
+// editorReadEvent waits for the next event. termbox reads the windows
+// console one key at a time, so a paste comes in as typed keys.
+func editorReadEvent() editorEvent {
+	ev := tb.PollEvent()
+	if ev.Type == tb.EventInterrupt {
+		editorInterrupted()
+	}
+	return editorEvent{Event: ev}
+}
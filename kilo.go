@@ -3,13 +3,34 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math/rand"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 	tb "github.com/nsf/termbox-go"
@@ -35,7 +56,10 @@ const (
 	HL_MLCOMMENT
 	HL_KEYWORD1
 	HL_KEYWORD2
-	HL_MATCH
+	HL_MATCH             // the current search match
+	HL_MATCH_OTHER       // the other search matches
+	HL_BRACKET           // a bracket and its partner, around the cursor
+	HL_UNMATCHED_BRACKET // a bracket without a partner
 )
 
 type editorRow struct {
@@ -45,7 +69,10 @@ type editorRow struct {
 	rsize         int
 	renderChars   []rune            // 需要渲染的字符集合
 	hl            []editorHighlight // for highlighting
-	hlOpenComment bool
+	hlOpenComment bool              // whether the row ends inside a comment
+	hlStart       bool              // whether hl was computed starting inside a comment
+	hlDone        bool              // whether hl is computed for the current content
+	version       int               // changes whenever the row would be drawn differently
 }
 
 type editorConf struct {
@@ -56,14 +83,32 @@ type editorConf struct {
 	cursorX         int
 	renderCursorX   int // index into the renderChars field
 	cursorY         int
+	goalRx          int // the display column vertical motions aim for, -1 if unset
 	rows            []*editorRow
 	numRows         int
+	pieces          *pieceTable        // the content of a large file, instead of rows
+	rowCache        map[int]*editorRow // the rows of a large file read so far
+	hlValid         int                // the rows before it are highlighted correctly
 	rowOffset       int
 	colOffset       int
 	filename        string
 	statusMsg       string
 	statusMsgTime   time.Time // the timestamp when we set a statusMsg
 	modified        bool
+	autoPair        bool         // insert closing brackets and quotes automatically
+	readOnly        bool         // edits are refused, and keys move around like in less
+	dirPath         string       // the directory listed, if this is a directory buffer
+	dirEntries      []dirEntry   // the entries listed, from row DIRED_HEADER_ROWS on
+	grepPattern     string       // the pattern searched for, if this is a grep results buffer
+	grepMatches     []grepMatch  // the matches listed, from row GREP_HEADER_ROWS on
+	title           string       // the name of a buffer without a file, eg, "*grep*"
+	disk            diskInfo     // the file as we last read or wrote it
+	compression     *compression // how the file is compressed, nil if it isn't
+	hexMode         bool         // the rows are a hex dump of hexData
+	hexData         []byte       // the bytes of a binary file
+	markSet         bool         // C-SPC has set the mark
+	markY, markX    int          // the mark, the other end of the region from the cursor
+	diskKept        diskInfo     // a change on disk the user chose to ignore
 	syntax          *editorSyntax
 }
 
@@ -77,6 +122,11 @@ type editorSyntax struct {
 	multilineCommentEnd   string
 	keywords              []string
 	flags                 int
+	indentAfter           string // a newline after one of these gets one more level of indentation
+	dedentOn              string // typing one of these on a blank line removes one level
+	indentTabs            bool   // indent with tabs instead of spaces
+	indentWidth           int    // number of spaces per level, if not indentTabs
+	formatter             string // a shell command formatting stdin to stdout, run on save, eg, gofmt
 }
 
 const (
@@ -93,6 +143,36 @@ var (
 		"int|", "long|", "double|", "float|", "char|", "unsigned|", "signed|",
 		"void|",
 	}
+	PY_HL_EXTENSIONS = []string{".py"}
+	PY_HL_KEYWORDS   = []string{
+		"def", "class", "if", "elif", "else", "for", "while", "break",
+		"continue", "return", "import", "from", "as", "with", "try", "except",
+		"finally", "raise", "pass", "lambda", "yield", "in", "is", "not", "and",
+		"or", "global", "nonlocal", "assert", "del",
+		"True|", "False|", "None|", "self|", "int|", "str|", "float|", "list|",
+		"dict|", "set|", "tuple|", "bool|",
+	}
+	GO_HL_EXTENSIONS = []string{".go"}
+	GO_HL_KEYWORDS   = []string{
+		"break", "case", "chan", "const", "continue", "default", "defer",
+		"else", "fallthrough", "for", "func", "go", "goto", "if", "import",
+		"interface", "map", "package", "range", "return", "select", "struct",
+		"switch", "type", "var",
+		"bool|", "byte|", "error|", "int|", "int64|", "float64|", "rune|",
+		"string|", "uint|", "any|", "nil|", "true|", "false|",
+	}
+
+	// the syntax of grep results buffers, it's never matched by file name
+	GREP_SYNTAX = editorSyntax{
+		fileType: "grep",
+		flags:    HL_HIGHLIGHT_NUMBERS,
+	}
+
+	// the syntax of directory buffers, it's never matched by file name
+	DIRED_SYNTAX = editorSyntax{
+		fileType: "dired",
+		flags:    HL_HIGHLIGHT_NUMBERS,
+	}
 
 	HLDB = []editorSyntax{
 		{
@@ -103,15 +183,49 @@ var (
 			multilineCommentEnd:    "*/",
 			keywords:               C_HL_KEYWORDS,
 			flags:                  HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS,
+			indentAfter:            "{([",
+			dedentOn:               "})]",
+			indentWidth:            4,
+		},
+		{
+			fileType:               "python",
+			fileMatch:              PY_HL_EXTENSIONS,
+			singlelineCommentStart: "#",
+			keywords:               PY_HL_KEYWORDS,
+			flags:                  HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS,
+			indentAfter:            ":([{",
+			dedentOn:               ")]}",
+			indentWidth:            4,
+		},
+		{
+			fileType:               "go",
+			fileMatch:              GO_HL_EXTENSIONS,
+			singlelineCommentStart: "//",
+			multilineCommentStart:  "/*",
+			multilineCommentEnd:    "*/",
+			keywords:               GO_HL_KEYWORDS,
+			flags:                  HL_HIGHLIGHT_NUMBERS | HL_HIGHLIGHT_STRINGS,
+			indentAfter:            "{([",
+			dedentOn:               "})]",
+			indentTabs:             true,
+			formatter:              "gofmt",
 		},
 	}
 )
 
-var E *editorConf
+var E *editorConf         // the current buffer
+var saveHelper string     // the command that saves what we may not write, "" to never use one
+var formatOnSave = true   // run the formatter of the file type before saving
+var buffers []*editorConf // every open buffer, in the order they were opened
 var logger *log.Logger
 
 func main() {
 	fileNamePtr := flag.String("f", "", "file to open")
+	sessionPtr := flag.Bool("session", false, "reopen the files that were open at the last exit")
+	autoPairPtr := flag.Bool("autopair", true, "insert closing brackets and quotes automatically")
+	readOnlyPtr := flag.Bool("R", false, "open the file read-only, in view mode")
+	flag.BoolVar(&formatOnSave, "format", true, "run the formatter of the file type, eg, gofmt, when saving")
+	flag.StringVar(&saveHelper, "save-helper", "", "command to save files we may not write to, eg, \"sudo tee\", the file name is appended")
 
 	flag.Parse()
 
@@ -126,35 +240,136 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	defer tb.Close()
+	defer closeTerminal()
 
-	tb.SetInputMode(tb.InputEsc)
+	// InputAlt turns `ESC x` into x with ModAlt, for the M- commands
+	tb.SetInputMode(tb.InputAlt)
+	enableTerminalReports()
+	// a hangup or a kill still saves the session, once the editor is
+	// back to waiting for input
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	go func() {
+		<-signals
+		quitRequested.Store(true)
+		editorWakeUp()
+	}()
+	go watchDisk()
 
 	initEditor()
+	E.autoPair = *autoPairPtr
+	editorLoadState()
 
+	if *sessionPtr {
+		editorRestoreSession()
+	}
 	if *fileNamePtr != "" {
-		editorOpen(*fileNamePtr)
+		if !editorVisitFile(*fileNamePtr) {
+			editorExit(1, E.statusMsg)
+		}
+		E.readOnly = E.readOnly || *readOnlyPtr
 	}
 
-	editorSetStatusMsg("HELP: C-X C-S = save | C-X C-C = quit | C-S = find")
+	editorSetStatusMsg("HELP: C-X C-S = save | C-X C-F = open | C-X C-C = quit | C-S = find")
 	editorRefreshScreen()
 	editorProcessKeypress()
+	editorSaveSession()
+}
+
+var (
+	closeTerminalOnce sync.Once
+	quitRequested     atomic.Bool // a signal asked us to quit
+)
+
+// closeTerminal puts the terminal back the way it was
+func closeTerminal() {
+	closeTerminalOnce.Do(func() {
+		disableTerminalReports()
+		tb.Close()
+	})
+}
+
+// editorExit saves the session, puts the terminal back and exits with
+// code, from wherever the editor is. msg, if any, goes to stderr.
+func editorExit(code int, msg string) {
+	editorSaveSession()
+	closeTerminal()
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	os.Exit(code)
 }
 
 // editorProcessKeypress ...
 func editorProcessKeypress() {
 	kiloQuitTimes := KILO_QUIT_TIMES
 	var prevKey tb.Key
+	var metaGPressed bool // M-g is a prefix key
 loop:
 	for {
-		switch ev := tb.PollEvent(); ev.Type {
+		editorWatchFiles()
+		switch ev := editorReadEvent(); ev.Type {
+		case EventPaste:
+			if !editorIsListing() {
+				editorInsertText(ev.paste)
+			}
+			E.goalRx = -1
+			kiloQuitTimes = KILO_QUIT_TIMES
 		case tb.EventKey:
+			// C-X is a prefix key, it only applies to the next key
+			afterCtrlX := prevKey == tb.KeyCtrlX
+			prevKey = 0
+			// any other command forgets the goal column, search
+			// takes care of it itself
+			if ev.Mod&tb.ModAlt != 0 || (!isVerticalMotion(ev.Key) && ev.Key != tb.KeyCtrlS) {
+				E.goalRx = -1
+			}
+			if metaGPressed {
+				metaGPressed = false
+				// both M-g x and M-g M-x, in any mode
+				handled := true
+				switch ev.Ch {
+				case 'g':
+					editorGotoLine()
+				case 'n':
+					editorNextGrepMatch(1)
+				case 'p':
+					editorNextGrepMatch(-1)
+				default:
+					handled = false
+				}
+				if handled {
+					break
+				}
+			}
+			if E.dirPath != "" && !afterCtrlX && ev.Mod&tb.ModAlt == 0 && editorDiredProcessKey(ev.Key, ev.Ch) {
+				break
+			}
+			if E.grepPattern != "" && !afterCtrlX && ev.Mod&tb.ModAlt == 0 && editorGrepProcessKey(ev.Key, ev.Ch) {
+				break
+			}
+			if E.hexMode && !afterCtrlX && ev.Mod&tb.ModAlt == 0 && editorHexProcessKey(ev.Key, ev.Ch) {
+				break
+			}
+			if E.readOnly && !afterCtrlX && ev.Mod&tb.ModAlt == 0 && editorViewProcessKey(ev.Key, ev.Ch) {
+				break
+			}
+			if ev.Mod&tb.ModAlt != 0 {
+				if ev.Ch == 'g' {
+					metaGPressed = true
+					editorSetStatusMsg("M-g-")
+				} else {
+					editorProcessMetaKey(ev.Key, ev.Ch)
+				}
+				kiloQuitTimes = KILO_QUIT_TIMES
+				break
+			}
 			switch ev.Key {
 			case tb.KeyCtrlC:
-				if prevKey == tb.KeyCtrlX {
+				if afterCtrlX {
 					kiloQuitTimes--
-					if E.modified && kiloQuitTimes > 0 {
-						editorSetStatusMsg(fmt.Sprintf("WARNING!!! File has unsaved changes. Press C-X C-C %d more times to quit.", kiloQuitTimes))
+					if editorAnyModified() && kiloQuitTimes > 0 {
+						editorSetStatusMsg(fmt.Sprintf("WARNING!!! Buffers have unsaved changes. Press C-X C-C %d more times to quit.", kiloQuitTimes))
 					} else {
 						break loop
 					}
@@ -174,46 +389,62 @@ loop:
 			case tb.KeyCtrlL:
 				editorDelRow(E.cursorY)
 			case tb.KeyCtrlS:
-				if prevKey == tb.KeyCtrlX {
+				if afterCtrlX {
 					editorSave()
 				} else {
 					editorFind()
 				}
 			case tb.KeyCtrlX:
 				prevKey = ev.Key
+			case tb.KeyCtrlF:
+				if afterCtrlX {
+					editorFindFile()
+				} else {
+					editorMoveCursor(ev.Key)
+				}
+			case tb.KeyCtrlR:
+				if afterCtrlX {
+					editorRecentFiles()
+				}
+			case tb.KeyCtrlP:
+				if afterCtrlX {
+					editorFuzzyFindFile()
+				} else {
+					editorMoveCursor(ev.Key)
+				}
+			case tb.KeyCtrlRsqBracket:
+				editorJumpToMatchingBracket()
 			case tb.KeyHome, tb.KeyCtrlA:
 				E.cursorX = 0
 			case tb.KeyEnd, tb.KeyCtrlE:
 				if E.cursorY < E.numRows {
-					E.cursorX = E.rows[E.cursorY].size
+					E.cursorX = E.row(E.cursorY).size
 				}
 			case tb.KeyArrowDown, tb.KeyArrowUp,
 				tb.KeyArrowLeft, tb.KeyArrowRight,
-				tb.KeyCtrlN, tb.KeyCtrlP, tb.KeyCtrlB, tb.KeyCtrlF:
+				tb.KeyCtrlN, tb.KeyCtrlB:
 				editorMoveCursor(ev.Key)
 			case tb.KeyPgdn, tb.KeyPgup:
-				// To scroll up or down a page, we position
-				// the cursor either at the top or bottom of
-				// the screen, and then simulate an entire
-				// screen’s worth of ↑ or ↓ keypresses.
-				var key tb.Key
-				if ev.Key == tb.KeyPgdn {
-					key = tb.KeyArrowDown
-					E.cursorY = E.rowOffset + E.screenRows - 1
-					if E.cursorY > E.numRows {
-						E.cursorY = E.numRows
-					}
-				} else {
-					key = tb.KeyArrowUp
-					E.cursorY = E.rowOffset
-				}
-
-				times := E.screenRows
-				for ; times > 0; times-- {
-					editorMoveCursor(key)
+				editorScrollPage(ev.Key == tb.KeyPgdn)
+			case tb.KeyCtrlQ:
+				if afterCtrlX {
+					editorToggleReadOnly()
 				}
 			default:
 				// logger.Printf("ev: %+v\n", ev)
+				if afterCtrlX && ev.Ch == 'b' {
+					editorSwitchBuffer()
+					break
+				} else if afterCtrlX && ev.Ch == 'k' {
+					editorKillBuffer()
+					break
+				} else if afterCtrlX && ev.Ch == 'g' {
+					editorGrep()
+					break
+				} else if ev.Key == tb.KeyCtrlSpace && ev.Ch == 0 {
+					editorSetMark()
+					break
+				}
 				if ev.Key == tb.KeySpace || ev.Ch != 0 {
 					keyPressed := ev.Ch
 					if ev.Key == tb.KeySpace {
@@ -224,15 +455,79 @@ loop:
 				// when pressing other keys, reset the quit time
 				kiloQuitTimes = KILO_QUIT_TIMES
 			}
+		case tb.EventResize:
+			editorResize()
+		case EventFocus:
+			editorCheckDisk()
 		case tb.EventError:
-			panic(ev.Err)
+			editorExit(1, ev.Err.Error())
+		}
+		// the watcher may have woken us up while a prompt was open
+		if diskChanged.Swap(false) {
+			editorCheckDisk()
 		}
 
 		editorRefreshScreen()
 	}
 }
 
+// editorProcessMetaKey handles the M- (Alt) commands
+func editorProcessMetaKey(key tb.Key, ch rune) {
+	switch {
+	case ch == 'f':
+		E.cursorY, E.cursorX = editorForwardWordPos(E.cursorY, E.cursorX)
+	case ch == 'b':
+		E.cursorY, E.cursorX = editorBackwardWordPos(E.cursorY, E.cursorX)
+	case ch == 'd':
+		cy, cx := editorForwardWordPos(E.cursorY, E.cursorX)
+		editorDelRegion(E.cursorY, E.cursorX, cy, cx)
+	case key == tb.KeyBackspace2 || key == tb.KeyBackspace:
+		cy, cx := editorBackwardWordPos(E.cursorY, E.cursorX)
+		editorDelRegion(cy, cx, E.cursorY, E.cursorX)
+	case ch == '}':
+		E.cursorY, E.cursorX = editorForwardParagraph(E.cursorY), 0
+	case ch == '{':
+		E.cursorY, E.cursorX = editorBackwardParagraph(E.cursorY), 0
+	case ch == '<':
+		E.cursorY, E.cursorX = 0, 0
+	case ch == '>':
+		E.cursorY, E.cursorX = E.numRows, 0
+	case ch == '!':
+		editorShellCommand()
+	case ch == '|':
+		editorFilterRegion()
+	}
+}
+
+// editorScrollPage moves the cursor a page down, or up
+func editorScrollPage(down bool) {
+	// To scroll up or down a page, we position
+	// the cursor either at the top or bottom of
+	// the screen, and then simulate an entire
+	// screen’s worth of ↑ or ↓ keypresses.
+	var key tb.Key
+	editorSetGoalRx()
+	if down {
+		key = tb.KeyArrowDown
+		E.cursorY = E.rowOffset + E.screenRows - 1
+		if E.cursorY > E.numRows {
+			E.cursorY = E.numRows
+		}
+	} else {
+		key = tb.KeyArrowUp
+		E.cursorY = E.rowOffset
+	}
+
+	times := E.screenRows
+	for ; times > 0; times-- {
+		editorMoveCursor(key)
+	}
+}
+
 func editorMoveCursor(key tb.Key) {
+	if isVerticalMotion(key) {
+		editorSetGoalRx()
+	}
 	switch key {
 	case tb.KeyArrowDown, tb.KeyCtrlN:
 		if E.cursorY < E.numRows {
@@ -248,68 +543,203 @@ func editorMoveCursor(key tb.Key) {
 		}
 	case tb.KeyArrowRight, tb.KeyCtrlF:
 		if E.cursorY < E.numRows {
-			row := E.rows[E.cursorY]
+			row := E.row(E.cursorY)
 			if E.cursorX < row.size {
 				E.cursorX++
 			}
 		}
 	}
 
-	// 当移动到下一行的时候，移动到行末
-	if E.cursorY != E.numRows {
-		row := E.rows[E.cursorY]
-		rowLen := row.size
-		if E.cursorX > rowLen {
-			if rowLen > 0 {
-				E.cursorX = rowLen - 1
-			} else {
-				E.cursorX = 0
-			}
-		}
-	} else {
+	if E.cursorY == E.numRows {
 		E.cursorX = 0
+	} else if isVerticalMotion(key) {
+		// 当移动到下一行的时候，尽量回到原来的显示列
+		E.cursorX = editorRowRxToCx(E.row(E.cursorY), E.goalRx)
+	} else if E.cursorX > E.row(E.cursorY).size {
+		E.cursorX = E.row(E.cursorY).size
+	}
+}
+
+func isVerticalMotion(key tb.Key) bool {
+	switch key {
+	case tb.KeyArrowDown, tb.KeyArrowUp, tb.KeyCtrlN, tb.KeyCtrlP,
+		tb.KeyPgdn, tb.KeyPgup:
+		return true
+	}
+	return false
+}
+
+// editorSetGoalRx remembers the cursor's display column as the goal
+// column, unless a previous vertical motion has already set one
+func editorSetGoalRx() {
+	if E.goalRx >= 0 {
+		return
+	}
+	E.goalRx = 0
+	if E.cursorY < E.numRows {
+		E.goalRx = editorRowCxToRx(E.row(E.cursorY), E.cursorX)
 	}
 }
 
 func editorRefreshScreenSize() {
-	w, h := tb.Size()
+	editorSetScreenSize(tb.Size())
+}
+
+// editorSetScreenSize lays the current buffer out on a w x h screen
+func editorSetScreenSize(w, h int) {
 	E.screenCols = w
 	// save last two lines for status bar and status msg
 	E.screenRows = h - 2
-	E.statusBarRowIdx = h - 2
-	E.msgBarRowIdx = h - 1
+	// always keep at least one text row, so that editorScroll
+	// still has somewhere to put the cursor on a tiny terminal
+	if E.screenRows < 1 {
+		E.screenRows = 1
+	}
+	if E.screenCols < 1 {
+		E.screenCols = 1
+	}
+	// the bars may be off screen, but never above it
+	E.statusBarRowIdx = max(h-2, 0)
+	E.msgBarRowIdx = max(h-1, 0)
+}
+
+// editorResize relayouts the editor after the terminal has been
+// resized. termbox only picks up the new size on Clear/Flush, so
+// clear first and then re-read it.
+func editorResize() {
+	tb.Clear(ColDef, ColDef)
+	editorDamageRows(0, len(drawnRows))
+	editorRefreshScreenSize()
+	editorRelayout()
+}
+
+// editorRelayout brings the cursor and the offsets of the current
+// buffer within the screen size
+func editorRelayout() {
+	if E.cursorY > E.numRows {
+		E.cursorY = E.numRows
+	}
+	if E.cursorY < E.numRows {
+		if E.cursorX > E.row(E.cursorY).size {
+			E.cursorX = E.row(E.cursorY).size
+		}
+	} else {
+		E.cursorX = 0
+	}
+	// don't leave blank space below the last row when the screen grows
+	if E.rowOffset > 0 && E.rowOffset+E.screenRows > E.numRows {
+		E.rowOffset = max(E.numRows-E.screenRows, 0)
+	}
+	// editorScroll brings the cursor back into view, the column offset
+	// only changes if it's needed for that
+	editorScroll()
 }
 
 func initEditor() {
-	E = &editorConf{}
+	E = &editorConf{goalRx: -1}
+	buffers = []*editorConf{E}
 	editorRefreshScreenSize()
 }
 
 func editorRefreshScreen() {
-	editorScroll()
-	tb.SetCursor(E.renderCursorX-E.colOffset, E.cursorY-E.rowOffset)
-	// get size again before redrawAll, because the
-	// ui may be resized
-	tb.Clear(ColDef, ColDef)
+	// get size again before scrolling and placing the cursor,
+	// because the ui may be resized
 	editorRefreshScreenSize()
+	editorDrawScreen()
+	if promptCursorX >= 0 {
+		tb.SetCursor(promptCursorX, E.msgBarRowIdx)
+	} else {
+		tb.SetCursor(E.renderCursorX-E.colOffset, E.cursorY-E.rowOffset)
+	}
+	tb.Flush()
+}
 
+// editorDrawScreen draws the editor into termbox's back buffer. The
+// screen isn't cleared, the text rows that haven't changed are left as
+// they are.
+func editorDrawScreen() {
+	editorScroll()
+	editorTrimRowCache()
+	editorHighlightScreen()
 	editorDrawRows()
+	editorDrawCandidates()
+	editorDrawPicker()
 	editorDrawStatusBar()
 	editorDrawMsgbar()
-
-	tb.Flush()
 }
 
-func editorOpen(fileName string) {
+// editorOpen reads fileName into the (empty) current buffer. A file
+// that doesn't exist yet is a new, empty buffer to be saved as
+// fileName.
+func editorOpen(fileName string) error {
+	if fi, err := os.Stat(fileName); err == nil && fi.IsDir() {
+		return editorOpenDir(fileName)
+	} else if err == nil && fi.Mode().IsRegular() && fi.Size() >= LARGE_FILE_SIZE {
+		head := sniffHead(fileName, BINARY_SNIFF_LEN)
+		// a compressed file is read whole, to be decompressed
+		if detectCompression(head) == nil {
+			// the hex view holds the whole file in memory
+			if isBinary(head) {
+				return fmt.Errorf("%s is a binary file, too large to show in hex", fileName)
+			}
+			return editorOpenLarge(fileName)
+		}
+	}
 	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		E.filename = fileName
+		editorSelectSyntaxHighlight()
+		editorSetStatusMsg("(New file)")
+		return nil
+	}
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer f.Close()
+	// hash while reading, to tell later if the file has been changed
+	hash := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(f, hash))
+	magic, _ := reader.Peek(MAX_MAGIC_LEN)
+	if E.compression = detectCompression(magic); E.compression != nil {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if data, err = E.compression.decompress(data); err != nil {
+			return fmt.Errorf("can't decompress %s: %v", E.compression.name, err)
+		}
+		reader = bufio.NewReader(bytes.NewReader(data))
+	}
+	// a binary file is shown in hex
+	if sniff, _ := reader.Peek(BINARY_SNIFF_LEN); isBinary(sniff) {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		editorHexLoad(data)
+	} else if err := editorReadRows(reader); err != nil {
+		return err
 	}
-	reader := bufio.NewReader(f)
+	E.filename = fileName
+	E.modified = false
+	E.readOnly = !fileWritable(fileName)
+	if fi, err := f.Stat(); err == nil {
+		E.disk = diskInfo{modTime: fi.ModTime(), size: fi.Size()}
+		hash.Sum(E.disk.hash[:0])
+	}
+	editorSelectSyntaxHighlight()
+	editorRestorePosition()
+	editorRecordRecent(E)
+	return nil
+}
+
+// editorReadRows reads the rows of the current buffer from reader
+func editorReadRows(reader *bufio.Reader) error {
 	var readErr error
 	var line string
 	line, readErr = reader.ReadString('\n')
-	for readErr == nil {
+	// the last line may not end with a newline
+	for readErr == nil || (readErr == io.EOF && line != "") {
 		// remove newline
 		end := len(line) - 1
 		for end >= 0 && (line[end] == '\r' || line[end] == '\n') {
@@ -319,26 +749,210 @@ func editorOpen(fileName string) {
 		chars := line[:end+1]
 		editorInsertRow(E.numRows, []rune(chars))
 
+		if readErr != nil {
+			break
+		}
 		line, readErr = reader.ReadString('\n')
 	}
-	E.filename = fileName
-	E.modified = false
-	editorSelectSyntaxHighlight()
+	if readErr != io.EOF {
+		return readErr
+	}
+	return nil
+}
+
+// editorResetBuffer replaces the current buffer with an empty one,
+// keeping the editor-wide settings
+func editorResetBuffer() {
+	i := slices.Index(buffers, E)
+	if E.pieces != nil {
+		E.pieces.close()
+	}
+	E = &editorConf{goalRx: -1, autoPair: E.autoPair}
+	if i >= 0 {
+		buffers[i] = E
+	}
+	editorRefreshScreenSize()
+}
+
+// editorChoose asks question in the message bar until one of the
+// choices is answered, it returns 0 if the prompt is cancelled
+func editorChoose(question string, choices string) rune {
+	for {
+		answer := strings.ToLower(editorPrompt(strings.ReplaceAll(question, "%", "%%")+" %s", "", nil, nil))
+		if answer == "" {
+			return 0
+		}
+		if c := []rune(answer)[0]; strings.ContainsRune(choices, c) {
+			return c
+		}
+	}
+}
+
+// editorConfirm asks a yes/no question in the message bar
+func editorConfirm(question string) bool {
+	answer := editorPrompt(strings.ReplaceAll(question, "%", "%%")+" (y/n) %s", "", nil, nil)
+	return strings.HasPrefix(strings.ToLower(answer), "y")
+}
+
+// editorFindFile reads a file name, with completion, and visits it
+func editorFindFile() {
+	fileName := editorPrompt("Find file: %s", HIST_FIND_FILE, nil, completePath)
+	if fileName == "" {
+		return
+	}
+	editorVisitFile(expandHome(fileName))
+}
+
+/***** buffers *****/
+
+// editorNewBuffer makes a new empty buffer the current one
+func editorNewBuffer() {
+	E = &editorConf{goalRx: -1, autoPair: E.autoPair}
+	buffers = append(buffers, E)
+	editorRefreshScreenSize()
+}
+
+// editorVisitFile switches to the buffer of fileName, opening it in a
+// new buffer if there isn't one yet. It reports whether it succeeded.
+func editorVisitFile(fileName string) bool {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		editorSetStatusMsg("Can't open %s: %v", fileName, err)
+		return false
+	}
+	for _, b := range buffers {
+		if b.filename == "" {
+			continue
+		}
+		if bAbs, err := filepath.Abs(b.filename); err == nil && bAbs == abs {
+			E = b
+			return true
+		}
+	}
+	// an untouched scratch buffer is as good as a new one
+	if E.filename != "" || E.numRows > 0 || E.modified {
+		editorNewBuffer()
+	}
+	if err := editorOpen(fileName); err != nil {
+		editorCloseBuffer(E)
+		editorSetStatusMsg("Can't open %s: %v", fileName, err)
+		return false
+	}
+	return true
+}
+
+// editorCloseBuffer closes b, if it's the current buffer the previous
+// one becomes current. There is always at least one buffer.
+func editorCloseBuffer(b *editorConf) {
+	i := slices.Index(buffers, b)
+	if i < 0 {
+		return
+	}
+	buffers = slices.Delete(buffers, i, i+1)
+	if b.pieces != nil {
+		b.pieces.close()
+	}
+	if E != b {
+		return
+	}
+	if len(buffers) == 0 {
+		E = &editorConf{goalRx: -1, autoPair: b.autoPair}
+		buffers = []*editorConf{E}
+	} else {
+		E = buffers[max(i-1, 0)]
+	}
+	editorRefreshScreenSize()
+}
+
+func editorKillBuffer() {
+	if E.modified && !editorConfirm("Buffer has unsaved changes, kill it anyway?") {
+		return
+	}
+	editorRecordRecent(E)
+	editorSaveState()
+	editorCloseBuffer(E)
+}
+
+// editorBufferName is how a buffer is shown in the status bar and the
+// buffer list
+func editorBufferName(b *editorConf) string {
+	if b.filename == "" && b.title != "" {
+		return b.title
+	}
+	if b.filename == "" {
+		return "[No Name]"
+	}
+	return b.filename
+}
+
+// editorAnyModified reports whether any buffer has unsaved changes
+func editorAnyModified() bool {
+	return slices.ContainsFunc(buffers, func(b *editorConf) bool {
+		return b.modified
+	})
+}
+
+// editorSwitchBuffer picks a buffer to switch to
+func editorSwitchBuffer() {
+	names := make([]string, len(buffers))
+	for i, b := range buffers {
+		names[i] = fmt.Sprintf("%d %s", i+1, editorBufferName(b))
+	}
+	picked := editorPick("Switch to buffer: %s", "", func() ([]string, bool) {
+		return names, true
+	})
+	if picked == "" {
+		return
+	}
+	var n int
+	fmt.Sscanf(picked, "%d", &n)
+	if n >= 1 && n <= len(buffers) {
+		E = buffers[n-1]
+		editorRefreshScreenSize()
+	}
 }
 
 func editorSave() {
+	if editorIsListing() {
+		editorSetStatusMsg("A listing can't be saved")
+		return
+	}
 	if E.filename == "" {
-		E.filename = editorPrompt("Save as: %v (ESC to cancle)", nil)
+		E.filename = expandHome(editorPrompt("Save as: %v (ESC to cancle)", HIST_SAVE_AS, nil, completePath))
 		if E.filename == "" {
 			editorSetStatusMsg("Save aborted")
 			return
 		}
 		editorSelectSyntaxHighlight()
 	}
-	var buffer bytes.Buffer
-	for _, erow := range E.rows {
-		buffer.WriteString(string(erow.rawChars))
-		buffer.WriteRune('\n')
+	// don't silently overwrite what someone else has written
+	if editorDiskChanged(E) {
+		switch editorChoose("File changed on disk: [r]eload, [o]verwrite, [d]iff or [c]ancel?", "rodc") {
+		case 'r':
+			editorReloadBuffer()
+			return
+		case 'd':
+			editorDiffWithDisk()
+			return
+		case 'o':
+		default:
+			editorSetStatusMsg("Save aborted")
+			return
+		}
+	}
+	if E.pieces != nil {
+		editorSaveLarge()
+		return
+	}
+	// a formatter failing doesn't stop the save, it's only reported
+	formatErr := editorFormat()
+	buffer := editorContent()
+	if E.compression != nil {
+		var err error
+		if buffer, err = E.compression.compress(buffer); err != nil {
+			editorSetStatusMsg("Can't save! %s failed: %v", E.compression.name, err)
+			return
+		}
 	}
 
 	file, err := os.OpenFile(E.filename, os.O_RDWR|os.O_CREATE, 0644)
@@ -352,20 +966,54 @@ func editorSave() {
 		// ftruncate() call succeeds but the write() call fails. In
 		// that case, the file would still contain most of the data it
 		// had before.
-		if err = file.Truncate(int64(buffer.Len())); err == nil {
-			if len, err := file.Write(buffer.Bytes()); err == nil {
-				editorSetStatusMsg(fmt.Sprintf("%d bytes written to disk", len))
-			}
+		if err = file.Truncate(int64(len(buffer))); err == nil {
+			_, err = file.Write(buffer)
 		}
 		file.Close()
-		E.modified = false
+		if err == nil {
+			editorSetStatusMsg(fmt.Sprintf("%d bytes written to disk", len(buffer)))
+			if formatErr != nil {
+				editorSetStatusMsg("%d bytes written to disk, unformatted: %v", len(buffer), formatErr)
+			}
+			E.modified = false
+			editorUpdateDiskInfo(buffer)
+			return
+		}
+	}
+	if os.IsPermission(err) && saveHelper != "" && !HAVE_PTY {
+		// it would have nowhere to ask for a password
+		editorSetStatusMsg("Can't save! %v, and %s needs a pseudo terminal, only supported on linux", err, saveHelper)
+		return
+	}
+	if os.IsPermission(err) && saveHelper != "" &&
+		editorConfirm(fmt.Sprintf("Permission denied, save with %q?", saveHelper)) {
+		editorSaveWithHelper(buffer)
 		return
 	}
 	editorSetStatusMsg(fmt.Sprintf("Can't save! I/O error: %s", err.Error()))
 }
 
+// editorContent returns what the current buffer writes to disk
+func editorContent() []byte {
+	if E.hexMode {
+		return E.hexData
+	}
+	return editorRowsToBytes()
+}
+
+// editorRowsToBytes returns the content of the current buffer as it's
+// written to disk
+func editorRowsToBytes() []byte {
+	var buffer bytes.Buffer
+	for i := 0; i < E.numRows; i++ {
+		buffer.WriteString(string(E.row(i).rawChars))
+		buffer.WriteRune('\n')
+	}
+	return buffer.Bytes()
+}
+
 func genRenderChars(rawChars []rune) []rune {
-	var res []rune
+	res := make([]rune, 0, len(rawChars))
 	for _, ch := range rawChars {
 		if ch == '\t' {
 			for i := 0; i < KILO_TAB_STOP; i++ {
@@ -382,13 +1030,17 @@ func editorUpdateRow(erow *editorRow) {
 	erow.renderChars = genRenderChars(erow.rawChars)
 	erow.rsize = len(erow.renderChars)
 	editorUpdateSyntax(erow)
+	// write a changed row of a large file back to its piece table
+	if E.pieces != nil && E.rowCache[erow.idx] == erow {
+		E.pieces.setLine(erow.idx, []byte(string(erow.rawChars)))
+	}
 }
 
 // editorRowCxToRx CursorX --> renderCursorX
 func editorRowCxToRx(erow *editorRow, cx int) int {
 	var rx int
 	for i := 0; i < cx; i++ {
-		width := runewidth.RuneWidth(erow.rawChars[i])
+		width := renderWidth(erow.rawChars[i])
 		if erow.rawChars[i] == '\t' {
 			rx += KILO_TAB_STOP
 		} else {
@@ -399,12 +1051,29 @@ func editorRowCxToRx(erow *editorRow, cx int) int {
 	return rx
 }
 
+// editorRowRenderIdxToCx index into renderChars --> cursorX
+func editorRowRenderIdxToCx(erow *editorRow, renderIdx int) int {
+	idx := 0
+	var i int
+	for i = 0; i < erow.size; i++ {
+		if erow.rawChars[i] == '\t' {
+			idx += KILO_TAB_STOP
+		} else {
+			idx++
+		}
+		if idx > renderIdx {
+			break
+		}
+	}
+	return i
+}
+
 // editorRowRxToCx renderCursorX --> cursorX
 func editorRowRxToCx(erow *editorRow, rx int) int {
 	currRx := 0
 	var i int
 	for i = 0; i < erow.size; i++ {
-		width := runewidth.RuneWidth(erow.rawChars[i])
+		width := renderWidth(erow.rawChars[i])
 		if erow.rawChars[i] == '\t' {
 			currRx += KILO_TAB_STOP
 		} else {
@@ -420,7 +1089,7 @@ func editorRowRxToCx(erow *editorRow, rx int) int {
 func editorScroll() {
 	E.renderCursorX = 0
 	if E.cursorY < E.numRows {
-		E.renderCursorX = editorRowCxToRx(E.rows[E.cursorY], E.cursorX)
+		E.renderCursorX = editorRowCxToRx(E.row(E.cursorY), E.cursorX)
 	}
 
 	if E.cursorY < E.rowOffset {
@@ -438,61 +1107,158 @@ func editorScroll() {
 	}
 }
 
-func editorDrawRows() {
-	// fmt.Printf("cols: %v, rows: %v\n", EConf.screenCols, EConf.screenRows)
-	for row := 0; row < E.screenRows; row++ {
-		fileRow := row + E.rowOffset
-		if fileRow >= E.numRows {
-			if E.numRows == 0 && row == E.screenRows/3 {
-				welcomeMsg := fmt.Sprintf("Kilo editor -- version %s", GKILO_VERSION)
-				padding := (E.screenCols - len(welcomeMsg)) / 2
+// drawnRow is a text row of the screen as it was last drawn. A screen
+// row is only drawn again once what it should show changes.
+type drawnRow struct {
+	erow      *editorRow // nil past the end of the buffer
+	version   int
+	colOffset int
+	welcome   bool
+	overlays  []overlaySpan
+	cells     []tb.Cell // nil if the screen row has to be drawn
+}
 
-				tb.SetCell(0, row, '~', ColWhi, ColDef)
-				tbprint(padding, row, ColWhi,
-					ColDef,
-					welcomeMsg)
-			}
-			tb.SetCell(0, row, '~', ColWhi, ColDef)
-		} else {
-			// https://viewsourcecode.org/snaptoken/kilo/04.aTextViewer.html#horizontal-scrolling
-			lineLen := E.rows[fileRow].size
-			displayLen := lineLen - E.colOffset
-			if displayLen < 0 {
-				displayLen = 0
-			}
-			// logger.Printf("lineLen: %v, idx: %v\n", lineLen, idx)
-			if displayLen > 0 {
-				erow := E.rows[fileRow]
-				chars := erow.renderChars[E.colOffset:] // display from offset
-				colIdx := 0
-				if displayLen > E.screenCols {
-					displayLen = E.screenCols // there are at most E.screenCols space to display
-				}
-				for i := 0; colIdx < displayLen; i++ {
-					if unicode.IsControl(chars[i]) {
-						var sym rune
-						if chars[i] <= 26 {
-							sym = '@' + chars[i]
-						} else {
-							sym = '?'
-						}
-						// use inverted color
-						tb.SetCell(colIdx, row, sym, ColDef, ColWhi)
-					} else {
-						textColor := editorSyntaxToColor(erow.hl[i])
-						tb.SetCell(colIdx, row, chars[i], textColor, ColDef)
-					}
-					colIdx += runewidth.RuneWidth(erow.renderChars[i])
-				}
-			}
-		}
-	}
+var (
+	drawnRows  []drawnRow // by screen row
+	drawnCols  int        // the width drawnRows were drawn for
+	rowVersion int        // the last version given to a row
+)
+
+// nextRowVersion returns the version of a row that has just changed.
+// Versions are never reused, not even by another row.
+func nextRowVersion() int {
+	rowVersion++
+	return rowVersion
 }
 
-// editorInsertRow it supports insert after the last element
-func editorInsertRow(rowIdx int, chars []rune) {
-	if rowIdx < 0 || rowIdx > E.numRows {
-		return
+// shows reports whether d has been drawn showing what want should
+func (d *drawnRow) shows(want *drawnRow) bool {
+	return d.cells != nil && d.erow == want.erow && d.version == want.version &&
+		d.colOffset == want.colOffset && d.welcome == want.welcome &&
+		slices.Equal(d.overlays, want.overlays)
+}
+
+// editorDamageRows makes the screen rows [from, to) be drawn again, as
+// something else has been drawn over them
+func editorDamageRows(from, to int) {
+	for y := max(from, 0); y < min(to, len(drawnRows)); y++ {
+		drawnRows[y].cells = nil
+	}
+}
+
+// editorDrawRows draws the text rows of the screen that changed since
+// the last refresh, and returns how many it drew. A row that has only
+// moved, eg, by scrolling, is drawn with the cells it had.
+func editorDrawRows() int {
+	if len(drawnRows) != E.screenRows || drawnCols != E.screenCols {
+		drawnRows = make([]drawnRow, E.screenRows)
+		drawnCols = E.screenCols
+	}
+	overlays := editorOverlays()
+	onScreen := make(map[*editorRow]drawnRow, len(drawnRows))
+	for _, d := range drawnRows {
+		if d.erow != nil && d.cells != nil {
+			onScreen[d.erow] = d
+		}
+	}
+	drawn := 0
+	for y := 0; y < E.screenRows; y++ {
+		fileRow := y + E.rowOffset
+		want := drawnRow{colOffset: E.colOffset, overlays: overlays[fileRow]}
+		if fileRow < E.numRows {
+			want.erow = E.row(fileRow)
+			want.version = want.erow.version
+		} else {
+			want.welcome = E.numRows == 0 && y == E.screenRows/3
+		}
+		if drawnRows[y].shows(&want) {
+			continue
+		}
+		if prev, ok := onScreen[want.erow]; ok && prev.shows(&want) {
+			want.cells = prev.cells
+		} else {
+			want.cells = editorRenderRow(&want)
+		}
+		drawnRows[y] = want
+		for x, c := range want.cells {
+			tb.SetCell(x, y, c.Ch, c.Fg, c.Bg)
+		}
+		drawn++
+	}
+	return drawn
+}
+
+// editorRenderRow returns the cells of a screen row showing d
+func editorRenderRow(d *drawnRow) []tb.Cell {
+	cells := make([]tb.Cell, E.screenCols)
+	for x := range cells {
+		cells[x] = tb.Cell{Ch: ' ', Fg: ColDef, Bg: ColDef}
+	}
+	if d.erow == nil {
+		cells[0] = tb.Cell{Ch: '~', Fg: ColWhi, Bg: ColDef}
+		if d.welcome {
+			welcomeMsg := fmt.Sprintf("Kilo editor -- version %s", GKILO_VERSION)
+			x := (E.screenCols - len(welcomeMsg)) / 2
+			for _, c := range welcomeMsg {
+				if x > 0 && x < len(cells) {
+					cells[x] = tb.Cell{Ch: c, Fg: ColWhi, Bg: ColDef}
+				}
+				x++
+			}
+		}
+		return cells
+	}
+	erow := d.erow
+	// https://viewsourcecode.org/snaptoken/kilo/04.aTextViewer.html#horizontal-scrolling
+	x := -d.colOffset
+	for i, c := range erow.renderChars {
+		if x >= len(cells) {
+			break
+		}
+		width := renderWidth(c)
+		switch {
+		case x < 0 || x+width > len(cells):
+			// a wide rune cut by an edge of the screen
+		case unicode.IsControl(c):
+			sym := '?'
+			if c <= 26 {
+				sym = '@' + c
+			}
+			// use inverted color
+			cells[x] = tb.Cell{Ch: sym, Fg: ColDef, Bg: ColWhi}
+		default:
+			hl := HL_NORMAl
+			if i < len(erow.hl) {
+				hl = erow.hl[i]
+			}
+			hl = overlayHL(d.overlays, i, hl)
+			cells[x] = tb.Cell{Ch: c, Fg: editorSyntaxToColor(hl), Bg: ColDef}
+		}
+		x += width
+	}
+	return cells
+}
+
+// renderWidth is the number of columns c takes on the screen, a
+// control character is shown as one, eg, ^A
+func renderWidth(c rune) int {
+	if unicode.IsControl(c) {
+		return 1
+	}
+	return runewidth.RuneWidth(c)
+}
+
+// editorInsertRow it supports insert after the last element
+func editorInsertRow(rowIdx int, chars []rune) {
+	if rowIdx < 0 || rowIdx > E.numRows || editorRefuseEdit() {
+		return
+	}
+	if E.pieces != nil {
+		E.pieces.insertLine(rowIdx, []byte(string(chars)))
+		editorDropRows(rowIdx)
+		E.numRows++
+		E.modified = true
+		return
 	}
 	erow := editorRow{
 		idx:      rowIdx,
@@ -515,6 +1281,7 @@ func editorInsertRow(rowIdx int, chars []rune) {
 			E.rows[i].idx += 1
 		}
 	}
+	editorInvalidateSyntax(rowIdx)
 
 	E.numRows++
 	E.modified = true
@@ -539,20 +1306,29 @@ func editorRowDelChar(erow *editorRow, at int) {
 
 // editorDelChar ...
 func editorDelChar() {
+	if editorRefuseEdit() {
+		return
+	}
 	if E.cursorY == E.numRows {
 		return
 	}
 
-	erow := E.rows[E.cursorY]
+	erow := E.row(E.cursorY)
 	// if there is a character to the left of the cursor
 	// we delete it and move the cursor one to the left
 	if E.cursorX > 0 {
+		// deleting the opening one of an empty pair, eg, `(|)`,
+		// deletes both
+		if E.autoPair && E.cursorX < erow.size &&
+			pairCloser(erow.rawChars[E.cursorX-1]) == erow.rawChars[E.cursorX] {
+			editorRowDelChar(erow, E.cursorX)
+		}
 		editorRowDelChar(erow, E.cursorX-1)
 		E.cursorX--
 	} else {
 		if E.cursorY > 0 {
 			// append the remaining of the current row to the previous line
-			prevRow := E.rows[E.cursorY-1]
+			prevRow := E.row(E.cursorY - 1)
 			E.cursorX = prevRow.size
 			editorRowAppendChars(prevRow, erow.rawChars...)
 			// delete current row
@@ -564,7 +1340,14 @@ func editorDelChar() {
 
 // editorDelRow delete the row at `rowIdx`
 func editorDelRow(rowIdx int) {
-	if rowIdx < 0 || rowIdx >= E.numRows {
+	if rowIdx < 0 || rowIdx >= E.numRows || editorRefuseEdit() {
+		return
+	}
+	if E.pieces != nil {
+		E.pieces.deleteLine(rowIdx)
+		editorDropRows(rowIdx)
+		E.numRows--
+		E.modified = true
 		return
 	}
 
@@ -574,16 +1357,41 @@ func editorDelRow(rowIdx int) {
 	for i := rowIdx; i < E.numRows; i++ {
 		E.rows[i].idx -= 1
 	}
+	editorInvalidateSyntax(rowIdx)
+	E.modified = true
+}
+
+// editorDelRegion deletes the text between (y1, x1) and (y2, x2),
+// which may span several rows, and moves the cursor to (y1, x1)
+func editorDelRegion(y1, x1, y2, x2 int) {
+	if y1 > y2 || (y1 == y2 && x1 >= x2) || y1 >= E.numRows || editorRefuseEdit() {
+		return
+	}
+	erow := E.row(y1)
+	var tail []rune
+	if y2 < E.numRows {
+		tail = append(tail, E.row(y2).rawChars[x2:]...)
+	}
+	erow.rawChars = append(erow.rawChars[:x1], tail...)
+	erow.size = len(erow.rawChars)
+	for i := min(y2, E.numRows-1); i > y1; i-- {
+		editorDelRow(i)
+	}
+	editorUpdateRow(erow)
+	E.cursorY, E.cursorX = y1, x1
 	E.modified = true
 }
 
 // editorInsertNewline ...
 func editorInsertNewline() {
+	if editorRefuseEdit() {
+		return
+	}
 	if E.cursorY < 0 || E.cursorY >= E.numRows {
 		return
 	}
 
-	erow := E.rows[E.cursorY]
+	erow := E.row(E.cursorY)
 	if E.cursorX < 0 || E.cursorX > erow.size {
 		return
 	}
@@ -591,22 +1399,102 @@ func editorInsertNewline() {
 	// before the current row
 	if E.cursorX == 0 {
 		editorInsertRow(E.cursorY, []rune(""))
-	} else {
-		var charsToMove []rune
-		if E.cursorX != erow.size {
-			charsToMove = erow.rawChars[E.cursorX:]
-			erow.rawChars = erow.rawChars[:E.cursorX]
-			erow.size -= len(charsToMove)
-			editorUpdateRow(erow)
-		}
-		editorInsertRow(E.cursorY+1, charsToMove)
+		E.cursorY++
+		return
+	}
+
+	// a bracket in a string or a comment doesn't open a block
+	opened := false
+	if E.syntax != nil {
+		head := trimTrailingWhitespace(erow.rawChars[:E.cursorX])
+		opened = len(head) > 0 && strings.ContainsRune(E.syntax.indentAfter, head[len(head)-1]) &&
+			!editorInStringOrComment(erow, len(head)-1)
+	}
+	// copy so that the new row doesn't share memory with erow
+	charsToMove := append([]rune{}, erow.rawChars[E.cursorX:]...)
+	erow.rawChars = erow.rawChars[:E.cursorX]
+	erow.size = len(erow.rawChars)
+	// the new row starts with the indentation of the current row, plus
+	// one level after an opening bracket
+	charsToMove = trimLeadingWhitespace(charsToMove)
+	indent := leadingWhitespace(erow.rawChars)
+	erow.rawChars = trimTrailingWhitespace(erow.rawChars)
+	erow.size = len(erow.rawChars)
+	editorUpdateRow(erow)
+
+	newIndent := indent
+	if opened {
+		newIndent = append(append([]rune{}, indent...), editorIndentUnit()...)
 	}
+	if opened && len(charsToMove) > 0 && strings.ContainsRune(E.syntax.dedentOn, charsToMove[0]) {
+		// the cursor was between a pair of brackets, eg, `{|}`, put
+		// the closing one on its own row at the original indentation
+		editorInsertRow(E.cursorY+1, append(append([]rune{}, indent...), charsToMove...))
+		charsToMove = nil
+	}
+	editorInsertRow(E.cursorY+1, append(append([]rune{}, newIndent...), charsToMove...))
 
 	// update the cursor
-	E.cursorX = 0
+	E.cursorX = len(newIndent)
 	E.cursorY++
 }
 
+// editorIndentUnit returns one level of indentation for the current
+// file type
+func editorIndentUnit() []rune {
+	if E.syntax == nil || E.syntax.indentTabs {
+		return []rune{'\t'}
+	}
+	width := E.syntax.indentWidth
+	if width <= 0 {
+		width = KILO_TAB_STOP
+	}
+	return []rune(strings.Repeat(" ", width))
+}
+
+// editorDedentRow removes one level of indentation from the start of
+// erow, it returns the number of runes removed
+func editorDedentRow(erow *editorRow) int {
+	indent := leadingWhitespace(erow.rawChars)
+	n := 0
+	if len(indent) > 0 && indent[len(indent)-1] == '\t' {
+		n = 1
+	} else {
+		for n < len(indent) && n < len(editorIndentUnit()) && indent[len(indent)-1-n] == ' ' {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	start := len(indent) - n
+	erow.rawChars = append(erow.rawChars[:start], erow.rawChars[len(indent):]...)
+	erow.size = len(erow.rawChars)
+	editorUpdateRow(erow)
+	E.modified = true
+	return n
+}
+
+func leadingWhitespace(chars []rune) []rune {
+	i := 0
+	for i < len(chars) && (chars[i] == ' ' || chars[i] == '\t') {
+		i++
+	}
+	return chars[:i]
+}
+
+func trimLeadingWhitespace(chars []rune) []rune {
+	return chars[len(leadingWhitespace(chars)):]
+}
+
+func trimTrailingWhitespace(chars []rune) []rune {
+	end := len(chars)
+	for end > 0 && (chars[end-1] == ' ' || chars[end-1] == '\t') {
+		end--
+	}
+	return chars[:end]
+}
+
 func editorRowAppendChars(erow *editorRow, chars ...rune) {
 	erow.rawChars = append(erow.rawChars, chars...)
 	erow.size += len(chars)
@@ -632,28 +1520,180 @@ func editorRowInsertChar(erow *editorRow, at int, c rune) {
 }
 
 func editorInsertChar(c rune) {
+	if editorRefuseEdit() {
+		return
+	}
 	if E.cursorY == E.numRows {
 		// appendRow
 		editorInsertRow(E.cursorY, []rune(""))
 	}
-	erow := E.rows[E.cursorY]
+	erow := E.row(E.cursorY)
+	if E.autoPair && editorInsertPair(erow, c) {
+		return
+	}
+	// a closing bracket typed on a blank line goes one level back
+	if E.syntax != nil && strings.ContainsRune(E.syntax.dedentOn, c) &&
+		len(leadingWhitespace(erow.rawChars)) == erow.size && E.cursorX == erow.size &&
+		!editorInStringOrComment(erow, E.cursorX) {
+		E.cursorX -= editorDedentRow(erow)
+	}
 	editorRowInsertChar(erow, E.cursorX, c)
 	// logger.Printf("rawChars: %c\n", erow.rawChars)
 	// logger.Printf("renderChars: %c\n", erow.renderChars)
 	E.cursorX++
 }
 
+// pairCloser returns the closing partner of c, or 0 if c doesn't
+// open a pair
+func pairCloser(c rune) rune {
+	switch c {
+	case '(':
+		return ')'
+	case '[':
+		return ']'
+	case '{':
+		return '}'
+	case '"', '\'':
+		return c
+	}
+	return 0
+}
+
+func isPairCloser(c rune) bool {
+	return strings.ContainsRune(")]}\"'", c)
+}
+
+// editorInsertPair handles typing c when auto-pairing is on: a closer
+// types over the same closer under the cursor, and an opener also
+// inserts its partner. It reports whether c has been dealt with.
+func editorInsertPair(erow *editorRow, c rune) bool {
+	if isPairCloser(c) && E.cursorX < erow.size && erow.rawChars[E.cursorX] == c {
+		E.cursorX++
+		return true
+	}
+	closer := pairCloser(c)
+	if closer == 0 || editorInStringOrComment(erow, E.cursorX) {
+		return false
+	}
+	// don't pair quotes used as apostrophes, eg, `don't`
+	if closer == c && E.cursorX > 0 && wordClass(erow.rawChars[E.cursorX-1]) != WORD_SEP {
+		return false
+	}
+	editorRowInsertChar(erow, E.cursorX, closer)
+	editorRowInsertChar(erow, E.cursorX, c)
+	E.cursorX++
+	return true
+}
+
+// editorRowCxToRenderIdx CursorX --> index into renderChars (and hl),
+// unlike renderCursorX this doesn't count wide chars twice
+func editorRowCxToRenderIdx(erow *editorRow, cx int) int {
+	idx := 0
+	for i := 0; i < cx && i < erow.size; i++ {
+		if erow.rawChars[i] == '\t' {
+			idx += KILO_TAB_STOP
+		} else {
+			idx++
+		}
+	}
+	return idx
+}
+
+// editorInStringOrComment reports whether the position cx of erow is
+// inside a string or a comment, judging from erow.hl
+func editorInStringOrComment(erow *editorRow, cx int) bool {
+	if E.syntax == nil {
+		return false
+	}
+	idx := editorRowCxToRenderIdx(erow, cx)
+	if idx == 0 {
+		return erow.hlStart
+	}
+	switch erow.hl[idx-1] {
+	case HL_COMMENT:
+		return true
+	case HL_MLCOMMENT:
+		// right after the end of the comment is outside of it
+		return !strings.HasSuffix(string(erow.renderChars[:idx]), E.syntax.multilineCommentEnd)
+	}
+	// replay the strings up to idx, the same way editorUpdateSyntax
+	// does
+	inStr := rune(0)
+	for i := 0; i < idx; i++ {
+		if erow.hl[i] != HL_STRING {
+			continue
+		}
+		c := erow.renderChars[i]
+		if inStr == rune(0) {
+			inStr = c
+		} else if c == '\\' {
+			i++
+		} else if c == inStr {
+			inStr = rune(0)
+		}
+	}
+	return inStr != rune(0)
+}
+
+// editorInsertText inserts a block of text at the cursor as a single
+// operation, splitting it into rows at newlines. Unlike
+// editorInsertChar, no per-character processing is done.
+func editorInsertText(text []rune) {
+	if editorRefuseEdit() {
+		return
+	}
+	if len(text) == 0 {
+		return
+	}
+	if E.cursorY == E.numRows {
+		editorInsertRow(E.cursorY, []rune(""))
+	}
+	lines := splitLines(text)
+	erow := E.row(E.cursorY)
+	// the chars after the cursor go to the end of the last pasted line
+	tail := append([]rune{}, erow.rawChars[E.cursorX:]...)
+	erow.rawChars = append(erow.rawChars[:E.cursorX], lines[0]...)
+	erow.size = len(erow.rawChars)
+	editorUpdateRow(erow)
+	for _, line := range lines[1:] {
+		E.cursorY++
+		editorInsertRow(E.cursorY, line)
+	}
+	erow = E.row(E.cursorY)
+	E.cursorX = erow.size
+	editorRowAppendChars(erow, tail...)
+	E.modified = true
+}
+
+// splitLines splits text at "\n", "\r\n" or a lone "\r" (which is what
+// most terminals send for a newline inside a paste)
+func splitLines(text []rune) [][]rune {
+	var lines [][]rune
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\n' && text[i] != '\r' {
+			continue
+		}
+		lines = append(lines, append([]rune{}, text[start:i]...))
+		if text[i] == '\r' && i+1 < len(text) && text[i+1] == '\n' {
+			i++
+		}
+		start = i + 1
+	}
+	return append(lines, append([]rune{}, text[start:]...))
+}
+
 func editorDrawStatusBar() {
 	fgColor := tb.ColorBlack
 	bgColor := tb.ColorWhite
-	filename := "[No Name]"
-	if E.filename != "" {
-		filename = E.filename
-	}
+	filename := editorBufferName(E)
 	dirtyMsg := ""
 	if E.modified {
 		dirtyMsg = "(modified)"
 	}
+	if E.readOnly {
+		dirtyMsg = strings.TrimSpace(dirtyMsg + " (read-only)")
+	}
 	// msg at the left end of the status bar
 	lMsg := fmt.Sprintf("%.*s - %d lines %s", FILENAME_MAX_PRINT, filename, E.numRows, dirtyMsg)
 	// msg at the right end of the status bar
@@ -661,6 +1701,13 @@ func editorDrawStatusBar() {
 	if E.syntax != nil {
 		fileTypeDisp = E.syntax.fileType
 	}
+	if E.hexMode {
+		fileTypeDisp = "hex"
+	}
+	if E.compression != nil {
+		// it's saved compressed again
+		fileTypeDisp += " | " + E.compression.name
+	}
 	rMsg := fmt.Sprintf("%s | %d/%d", fileTypeDisp, E.cursorY+1, E.numRows)
 	printLen := len(lMsg)
 	// print at most `E.screenCols` chars
@@ -680,6 +1727,9 @@ func editorDrawStatusBar() {
 
 // editorDrawMsgbar ...
 func editorDrawMsgbar() {
+	for x := 0; x < E.screenCols; x++ {
+		tb.SetCell(x, E.msgBarRowIdx, ' ', ColDef, ColDef)
+	}
 	now := time.Now()
 	if now.Sub(E.statusMsgTime) < 5*time.Second {
 		// 使用 "%.*s" 格式说明符，其中 * 表示动态指定宽度。
@@ -700,49 +1750,150 @@ func editorSetStatusMsg(strFmt string, args ...any) {
 	E.statusMsgTime = time.Now()
 }
 
-func editorPrompt(prompt string,
-	cb func(query string, lastKey tb.Key)) string {
-	var buffer bytes.Buffer
+// editorPrompt reads a line of input in the message bar, edited with
+// a minibuffer. history is the kind of prompt, previous inputs of the
+// same kind can be recalled with M-p/M-n, or Up/Down when there is no
+// cb. cb, if not nil, is called after every event and returns extra
+// info to show after the prompt. complete, if not nil, completes the
+// input on Tab and returns the candidates to list.
+func editorPrompt(prompt string, history string,
+	cb func(query string, lastKey tb.Key) string,
+	complete func(input string) (string, []string)) string {
+	var mb minibuffer
+	var info string
+	hist := state.History[history]
+	histIdx := len(hist) // len(hist) is the input being edited
+	var draft string     // the input being edited, while browsing history
+	defer func() {
+		promptCursorX = -1
+		promptCandidates = nil
+	}()
+	if cb != nil {
+		info = cb("", 0)
+	}
 
 	for {
-		editorSetStatusMsg(prompt, buffer.String())
+		shown := mb.chars
+		if promptSecret {
+			shown = []rune(strings.Repeat("*", len(mb.chars)))
+		}
+		editorSetStatusMsg(prompt, string(shown))
+		E.statusMsg += info
+		// put the cursor where the input is being edited, the marker
+		// tells where that is once the prompt is formatted
+		msg := fmt.Sprintf(prompt, string(shown[:mb.cursor])+"\x00")
+		if i := strings.IndexByte(msg, 0); i >= 0 {
+			msg = msg[:i]
+		}
+		promptCursorX = runewidth.StringWidth(msg)
 		editorRefreshScreen()
 
-		switch ev := tb.PollEvent(); ev.Type {
+		var lastKey tb.Key
+		ev := editorReadEvent()
+		if ev.Type == tb.EventInterrupt {
+			// background work has produced something, the input is
+			// the same, only a picker wants to know
+			if promptOnWake != nil {
+				info = promptOnWake()
+			}
+			continue
+		}
+		if ev.Type != tb.EventResize {
+			// the candidates are only good until the input changes
+			promptCandidates = nil
+			if cb == nil {
+				info = ""
+			}
+		}
+		switch ev.Type {
+		case EventPaste:
+			mb.insert(ev.paste)
+		case tb.EventResize:
+			// the input lives on, it's redrawn at the top of the loop
+			editorResize()
+			continue
+		case tb.EventError:
+			editorExit(1, ev.Err.Error())
 		case tb.EventKey:
-			if ev.Ch != 0 {
-				buffer.WriteRune(ev.Ch)
+			lastKey = ev.Key
+			prevHist := ev.Mod&tb.ModAlt != 0 && ev.Ch == 'p' || cb == nil && ev.Key == tb.KeyArrowUp
+			nextHist := ev.Mod&tb.ModAlt != 0 && ev.Ch == 'n' || cb == nil && ev.Key == tb.KeyArrowDown
+			if prevHist || nextHist {
+				if histIdx == len(hist) {
+					draft = mb.String()
+				}
+				if prevHist && histIdx > 0 {
+					histIdx--
+				} else if nextHist && histIdx < len(hist) {
+					histIdx++
+				}
+				if histIdx < len(hist) {
+					mb.set(hist[histIdx])
+				} else {
+					mb.set(draft)
+				}
+				// let cb see the recalled input as if it were typed
+				lastKey = 0
+			} else if ev.Key == tb.KeyTab && complete != nil {
+				completed, candidates := complete(mb.String())
+				mb.set(completed)
+				promptCandidates = candidates
+				if len(candidates) == 0 {
+					info = " [No match]"
+					continue
+				}
+			} else if ev.Key == tb.KeyCtrlS && len(mb.chars) == 0 && len(hist) > 0 &&
+				(history == HIST_SEARCH || history == HIST_HEX_SEARCH) {
+				// C-S C-S repeats the last search, other prompts take
+				// C-S as any other key
+				mb.set(hist[len(hist)-1])
+				lastKey = 0
 			} else if ev.Key == tb.KeyEnter {
 				editorSetStatusMsg("")
 				// cb need to be called here to let
 				// `editorFindCallback` get a chance to know about the
 				// event
-				cb(buffer.String(), ev.Key)
-				return buffer.String()
+				if cb != nil {
+					cb(mb.String(), ev.Key)
+				}
+				editorAddHistory(history, mb.String())
+				return mb.String()
 			} else if ev.Key == tb.KeyEsc {
 				editorSetStatusMsg("")
-				cb(buffer.String(), ev.Key)
-				return ""
-			} else if ev.Key == tb.KeyBackspace2 || ev.Key == tb.KeyDelete {
-				if buffer.Len() > 0 {
-					buffer.Truncate(buffer.Len() - 1)
+				if cb != nil {
+					cb(mb.String(), ev.Key)
 				}
+				return ""
+			} else if !mb.handleKey(ev.Event) && ev.Mod&tb.ModAlt != 0 {
+				// not for the prompt
+				continue
 			}
+		default:
+			continue
+		}
 
-			if cb != nil {
-				cb(buffer.String(), ev.Key)
-			}
+		if cb != nil {
+			info = cb(mb.String(), lastKey)
 		}
 	}
 }
 
 func editorFind() {
+	if E.hexMode {
+		editorHexFind()
+		return
+	}
 	savedCx := E.cursorX
 	savedCy := E.cursorY
 	savedRowOffset := E.rowOffset
 	savedColOffset := E.colOffset
-	query := editorPrompt("Search: %s (Use ESC/Arrow/Enter)", editorFindCallback)
-	if query == "" {
+	savedGoalRx := E.goalRx
+	query := editorPrompt("Search: %s (Use ESC/Arrow/Enter)", HIST_SEARCH, editorFindCallback, nil)
+	if query != "" {
+		// vertical motions now start from the match
+		E.goalRx = -1
+	} else {
+		E.goalRx = savedGoalRx
 		E.cursorX = savedCx
 		E.cursorY = savedCy
 		E.rowOffset = savedRowOffset
@@ -750,235 +1901,3512 @@ func editorFind() {
 	}
 }
 
+// searchMatch is the position of a match as a row and an index into
+// its renderChars
+type searchMatch struct {
+	row int
+	idx int
+}
+
 var (
-	lastMatch   int = -1
-	direction   int = 1
-	savedHL     []editorHighlight
-	savedHLline int
+	searchQuery   []rune             // the query being searched for, nil when not searching
+	searchMatches []searchMatch      // every match of searchQuery, in order
+	currentMatch  int           = -1 // index into searchMatches
 )
 
-func editorFindCallback(query string, lastKey tb.Key) {
-	if savedHL != nil {
-		copy(E.rows[savedHLline].hl, savedHL)
-		savedHL = nil
-	}
+// editorFindCallback moves to the first match after the cursor as the
+// query changes, and to the next/previous one on Arrow Down/Up. It
+// returns the "match N of M" counter for the prompt.
+func editorFindCallback(query string, lastKey tb.Key) string {
 	// when in `incremental search`, press Enter or Esc means the search is done
 	if lastKey == tb.KeyEnter || lastKey == tb.KeyEsc {
-		lastMatch = -1
-		direction = 1
-		return
-	} else if lastKey == tb.KeyArrowDown {
-		direction = 1
-	} else if lastKey == tb.KeyArrowUp {
-		direction = -1
-	} else { // 当不是方向键时，还是从头开始搜索
-		lastMatch = -1
-		direction = 1
-	}
-	if lastMatch == -1 { // if there is no lastMatch, search in the
-		// forward direction
-		direction = 1
-	}
-	curr := lastMatch
-	// TODO: current implemention continues to search in the "next" line, but
-	// the next match may still exists in the current line
-	for i := 0; i < E.numRows; i++ { // 最多搜索 numRows 行，思考一下 wrap around
-		curr += direction // 根据 direction 来移动到“下一行”来继续搜索
-		if curr == -1 {
-			curr = E.numRows - 1
-		} else if curr == E.numRows {
-			curr = 0
-		} // allow search to wrap around
-		erow := E.rows[curr]
-		rx := strings.Index(string(erow.renderChars), query)
-		// logger.Printf("query: %v, rx: %v\n", query, rx)
-		if rx >= 0 {
-			E.cursorY = curr
-			lastMatch = curr
-			// cursorX need a cx
-			E.cursorX = editorRowRxToCx(erow, rx)
-			// we set E.rowOffset so that we are scrolled to the very
-			// bottom of the file, which will cause editorScroll() to
-			// scroll upwards at the next screen refresh so that the
-			// matching line will be at the very top of the
-			// screen. This way, the user doesn’t have to look all
-			// over their screen to find where their cursor jumped to,
-			// and where the matching line is.
-			E.rowOffset = E.numRows
-			// save original hl for restore first
-			savedHLline = curr
-			savedHL = make([]editorHighlight, erow.rsize)
-			copy(savedHL, erow.hl)
-			// highlight the query
-			for i := rx; i < rx+len(query); i++ {
-				erow.hl[i] = HL_MATCH
-			}
-			break
+		searchQuery = nil
+		searchMatches = nil
+		currentMatch = -1
+		return ""
+	}
+	if lastKey == tb.KeyArrowDown || lastKey == tb.KeyArrowUp || lastKey == tb.KeyCtrlS {
+		if len(searchMatches) == 0 {
+			return editorSearchCounter()
+		}
+		// allow search to wrap around
+		if lastKey != tb.KeyArrowUp {
+			currentMatch = (currentMatch + 1) % len(searchMatches)
+		} else {
+			currentMatch = (currentMatch - 1 + len(searchMatches)) % len(searchMatches)
 		}
+	} else { // 当不是方向键时，从光标处重新开始搜索
+		searchQuery = []rune(query)
+		searchMatches = editorFindAll(searchQuery)
+		currentMatch = -1
+		if len(searchMatches) == 0 {
+			return editorSearchCounter()
+		}
+		// the first match at or after the cursor
+		cursorIdx := 0
+		if E.cursorY < E.numRows {
+			cursorIdx = editorRowCxToRenderIdx(E.row(E.cursorY), E.cursorX)
+		}
+		currentMatch = sort.Search(len(searchMatches), func(i int) bool {
+			m := searchMatches[i]
+			return m.row > E.cursorY || (m.row == E.cursorY && m.idx >= cursorIdx)
+		}) % len(searchMatches)
 	}
+
+	m := searchMatches[currentMatch]
+	E.cursorY = m.row
+	// cursorX need a cx
+	E.cursorX = editorRowRenderIdxToCx(E.row(m.row), m.idx)
+	// we set E.rowOffset so that we are scrolled to the very
+	// bottom of the file, which will cause editorScroll() to
+	// scroll upwards at the next screen refresh so that the
+	// matching line will be at the very top of the
+	// screen. This way, the user doesn’t have to look all
+	// over their screen to find where their cursor jumped to,
+	// and where the matching line is.
+	E.rowOffset = E.numRows
+	return editorSearchCounter()
 }
 
-// This function is often use
-func tbprint(x, y int, fg, bg tb.Attribute, msg string) {
-	for _, c := range msg {
-		tb.SetCell(x, y, c, fg, bg)
-		x += runewidth.RuneWidth(c)
+func editorSearchCounter() string {
+	if len(searchQuery) == 0 {
+		return ""
+	}
+	if len(searchMatches) == 0 {
+		return " [no match]"
 	}
+	return fmt.Sprintf(" [match %d of %d]", currentMatch+1, len(searchMatches))
 }
 
-const (
-	SEPS = ",.()+-/*=~%<>[];，；。：（）"
-)
+// editorFindAll returns every match of query in the buffer
+func editorFindAll(query []rune) []searchMatch {
+	var matches []searchMatch
+	if len(query) == 0 {
+		return matches
+	}
+	if E.pieces != nil {
+		return editorFindAllLarge(query)
+	}
+	for _, erow := range E.rows {
+		for _, idx := range runeIndexAll(erow.renderChars, query) {
+			matches = append(matches, searchMatch{erow.idx, idx})
+		}
+	}
+	return matches
+}
 
-/***** syntax highlighting *****/
-func isSeparator(c rune) bool {
-	return unicode.IsSpace(c) || strings.ContainsRune(SEPS, c)
+// runeIndexAll returns the index of every non-overlapping occurrence of
+// needle in s
+func runeIndexAll(s, needle []rune) []int {
+	var res []int
+	for i := 0; i+len(needle) <= len(s); {
+		if slices.Equal(s[i:i+len(needle)], needle) {
+			res = append(res, i)
+			i += len(needle)
+		} else {
+			i++
+		}
+	}
+	return res
 }
 
-func editorUpdateSyntax(erow *editorRow) {
-	if erow.hl == nil {
-		erow.hl = make([]editorHighlight, erow.rsize)
+// editorSearchOverlays highlights the matches on the visible rows as
+// HL_MATCH_OTHER, and the current one as HL_MATCH
+func editorSearchOverlays(overlays map[int][]overlaySpan) {
+	if len(searchQuery) == 0 {
+		return
 	}
-	// make erow.hl as big as rsize
-	if erow.rsize < len(erow.hl) {
-		erow.hl = erow.hl[:erow.rsize]
-	} else if erow.rsize > len(erow.hl) {
-		erow.hl = append(erow.hl, make([]editorHighlight, erow.rsize-len(erow.hl))...)
+	first := sort.Search(len(searchMatches), func(i int) bool {
+		return searchMatches[i].row >= E.rowOffset
+	})
+	for i := first; i < len(searchMatches) && searchMatches[i].row < E.rowOffset+E.screenRows; i++ {
+		m := searchMatches[i]
+		hl := HL_MATCH_OTHER
+		if i == currentMatch {
+			hl = HL_MATCH
+		}
+		overlays[m.row] = append(overlays[m.row], overlaySpan{m.idx, m.idx + len(searchQuery), hl})
 	}
-	// memset to default color first
-	for i := 0; i < len(erow.hl); i++ {
-		erow.hl[i] = HL_NORMAl
+}
+
+/***** completion *****/
+
+// the most rows the completion candidates take up
+const MAX_CANDIDATE_ROWS = 8
+
+// promptCandidates are the completions listed above the message bar
+var promptCandidates []string
+
+// promptOnWake, if set, is called when editorWakeUp interrupts a
+// prompt, and returns the new info to show after the input
+var promptOnWake func() string
+
+// expandHome expands a leading `~` in path to the home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
 	}
-	if E.syntax == nil {
-		return
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
 	}
+	return home + path[1:]
+}
 
-	keywords := E.syntax.keywords
-	scs := E.syntax.singlelineCommentStart
-	mcs := E.syntax.multilineCommentStart
-	mce := E.syntax.multilineCommentEnd
-	var i int
-	preSep := true
-	// used to indicate whether in a string currently, also used to
-	// store the quotes (" or ')
-	inStr := rune(0)
-	inComment := erow.idx > 0 && E.rows[erow.idx-1].hlOpenComment
-	for i = 0; i < erow.rsize; {
-		var prevHL editorHighlight
-		if i > 0 {
-			prevHL = erow.hl[i-1]
-		} else {
-			prevHL = HL_NORMAl
+// completePath completes input as far as all the matching files
+// agree, and returns the matching files as the candidates.
+// Directories end with a `/`, so that completion can go on into them.
+func completePath(input string) (string, []string) {
+	if input == "~" {
+		input = "~/"
+	}
+	dir, base := filepath.Split(input)
+	listDir := expandHome(dir)
+	if listDir == "" {
+		listDir = "."
+	}
+	entries, err := os.ReadDir(listDir)
+	if err != nil {
+		return input, nil
+	}
+	var candidates []string
+	for _, entry := range entries {
+		name := entry.Name()
+		// dotfiles only when asked for
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
 		}
-
-		// inStr == rune(0) means not in a string
-		// comment
-		if scs != "" && inStr == rune(0) && !inComment {
-			if strings.HasPrefix(string(erow.renderChars[i:]), scs) {
-				for j := i; j < erow.rsize; j++ { // make hl[i..] HL_COMMENT
-					erow.hl[j] = HL_COMMENT
-				}
-				break
+		if entry.IsDir() {
+			name += "/"
+		} else if entry.Type()&os.ModeSymlink != 0 {
+			if fi, err := os.Stat(filepath.Join(listDir, name)); err == nil && fi.IsDir() {
+				name += "/"
 			}
 		}
-		if mcs != "" && mce != "" && inStr == rune(0) { // not in str
-			if inComment {
-				erow.hl[i] = HL_MLCOMMENT
-				if strings.HasPrefix(string(erow.renderChars[i:]), mce) { // we met the end of ml_comment
-					for j := i; j < i+len(mce); j++ {
-						erow.hl[j] = HL_MLCOMMENT
-					}
-					i += len(mce)
-					preSep = true
+		candidates = append(candidates, name)
+	}
+	if len(candidates) == 0 {
+		return input, nil
+	}
+	return dir + commonPrefix(candidates), candidates
+}
+
+func commonPrefix(strs []string) string {
+	prefix := []rune(strs[0])
+	for _, s := range strs[1:] {
+		r := []rune(s)
+		n := 0
+		for n < len(prefix) && n < len(r) && prefix[n] == r[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// editorDrawCandidates lists promptCandidates in columns, just above
+// the status bar
+func editorDrawCandidates() {
+	if len(promptCandidates) == 0 {
+		return
+	}
+	width := 0
+	for _, c := range promptCandidates {
+		width = max(width, runewidth.StringWidth(c)+2)
+	}
+	cols := max(E.screenCols/width, 1)
+	rows := (len(promptCandidates) + cols - 1) / cols
+	maxRows := min(MAX_CANDIDATE_ROWS, E.screenRows)
+	more := 0
+	if rows > maxRows {
+		rows = maxRows
+		// keep the last cell to say how many aren't shown
+		more = len(promptCandidates) - (rows*cols - 1)
+	}
+	top := E.statusBarRowIdx - rows
+	editorDamageRows(top, E.statusBarRowIdx)
+	for y := top; y < E.statusBarRowIdx; y++ {
+		for x := 0; x < E.screenCols; x++ {
+			tb.SetCell(x, y, ' ', ColDef, ColDef)
+		}
+	}
+	for i, c := range promptCandidates {
+		if more > 0 && i == rows*cols-1 {
+			tbprint((i%cols)*width, top+i/cols, ColWhi, ColDef, fmt.Sprintf("(%d more)", more))
+			break
+		}
+		tbprint((i%cols)*width, top+i/cols, ColWhi, ColDef, c)
+	}
+}
+
+/***** picker *****/
+
+// the most rows the picker list takes up
+const MAX_PICKER_ROWS = 10
+
+var (
+	pickerItems []string // what the picker currently lists
+	pickerSel   int      // index into pickerItems
+)
+
+// editorPick reads a query and lets the user pick one of the items
+// that fuzzy match it, with Up/Down or C-P/C-N. source returns the
+// items so far and whether that's all of them, it's asked again
+// whenever editorWakeUp is called, so the items can come in while the
+// picker is open. It returns "" if nothing was picked.
+func editorPick(prompt string, history string, source func() ([]string, bool)) string {
+	var picked string
+	var matches []string
+	var lastQuery string
+	sel := 0
+	// list the items for query again
+	update := func(query string) string {
+		items, done := source()
+		matches = fuzzyFilter(query, items)
+		if query != lastQuery {
+			sel = 0
+			lastQuery = query
+		}
+		sel = min(max(sel, 0), max(len(matches)-1, 0))
+		pickerItems, pickerSel = matches, sel
+		info := fmt.Sprintf(" [%d/%d", len(matches), len(items))
+		if !done {
+			info += "..."
+		}
+		return info + "]"
+	}
+	// more items may have come in
+	promptOnWake = func() string { return update(lastQuery) }
+	defer func() {
+		pickerItems = nil
+		promptOnWake = nil
+	}()
+
+	editorPrompt(prompt, history, func(query string, lastKey tb.Key) string {
+		switch lastKey {
+		case tb.KeyEnter:
+			if sel < len(matches) {
+				picked = matches[sel]
+			}
+			return ""
+		case tb.KeyEsc:
+			return ""
+		case tb.KeyArrowUp, tb.KeyCtrlP:
+			sel--
+		case tb.KeyArrowDown, tb.KeyCtrlN:
+			sel++
+		}
+		return update(query)
+	}, nil)
+	return picked
+}
+
+// editorDrawPicker lists pickerItems just above the status bar, the
+// best match at the bottom, next to the prompt
+func editorDrawPicker() {
+	if len(pickerItems) == 0 {
+		return
+	}
+	rows := min(len(pickerItems), MAX_PICKER_ROWS, E.screenRows)
+	// scroll so that the selected item is shown
+	first := max(pickerSel-rows+1, 0)
+	editorDamageRows(E.statusBarRowIdx-rows, E.statusBarRowIdx)
+	for i := 0; i < rows; i++ {
+		y := E.statusBarRowIdx - 1 - i
+		fg, bg := ColWhi, ColDef
+		if first+i == pickerSel {
+			fg, bg = tb.ColorBlack, ColWhi
+		}
+		for x := 0; x < E.screenCols; x++ {
+			tb.SetCell(x, y, ' ', fg, bg)
+		}
+		if first+i < len(pickerItems) {
+			tbprint(0, y, fg, bg, pickerItems[first+i])
+		}
+	}
+}
+
+/***** fuzzy finder *****/
+
+// the most candidates fuzzyFilter returns, nobody scrolls further
+const MAX_FUZZY_MATCHES = 1000
+
+// editorFuzzyFindFile picks a file under the project root with a fuzzy
+// finder and visits it
+func editorFuzzyFindFile() {
+	cwd, err := os.Getwd()
+	if err != nil {
+		editorSetStatusMsg("Can't find the project root: %v", err)
+		return
+	}
+	root := findProjectRoot(cwd)
+	walker := startFileWalker(root)
+	defer walker.close()
+	picked := editorPick("Find file in "+strings.ReplaceAll(root, "%", "%%")+": %s", "", walker.snapshot)
+	if picked != "" {
+		editorVisitFile(filepath.Join(root, picked))
+	}
+}
+
+// findProjectRoot returns the closest directory from dir upwards that
+// has a .git, or dir itself if none has
+func findProjectRoot(dir string) string {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		if d == filepath.Dir(d) {
+			return dir
+		}
+	}
+}
+
+// fuzzyScore scores how well candidate matches query: every rune of
+// the query has to appear in order. Runes in a row, at the start of a
+// word and in the base name score higher. Matching is case insensitive
+// unless the query has upper case runes.
+func fuzzyScore(query, candidate string) (int, bool) {
+	q := []rune(query)
+	c := []rune(candidate)
+	ignoreCase := strings.ToLower(query) == query
+	if ignoreCase {
+		c = []rune(strings.ToLower(candidate))
+	}
+	base := strings.LastIndexByte(candidate, '/') + 1
+	baseIdx := len([]rune(candidate[:base]))
+	score := 0
+	prev := -2
+	j := 0
+	for i := 0; i < len(c) && j < len(q); i++ {
+		if c[i] != q[j] {
+			continue
+		}
+		score++
+		if i == prev+1 {
+			score += 5
+		}
+		if i == 0 || strings.ContainsRune("/_-. ", c[i-1]) {
+			score += 8
+		}
+		if i >= baseIdx {
+			score += 3
+		}
+		prev = i
+		j++
+	}
+	if j < len(q) {
+		return 0, false
+	}
+	return score, true
+}
+
+// fuzzyFilter returns the items matching query, the best first
+func fuzzyFilter(query string, items []string) []string {
+	if query == "" {
+		return items[:min(len(items), MAX_FUZZY_MATCHES)]
+	}
+	type scored struct {
+		item  string
+		score int
+	}
+	var matches []scored
+	for _, item := range items {
+		if score, ok := fuzzyScore(query, item); ok {
+			matches = append(matches, scored{item, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return len(matches[i].item) < len(matches[j].item)
+	})
+	res := make([]string, 0, min(len(matches), MAX_FUZZY_MATCHES))
+	for i := 0; i < len(matches) && i < MAX_FUZZY_MATCHES; i++ {
+		res = append(res, matches[i].item)
+	}
+	return res
+}
+
+// fileWalker lists the files under root in a goroutine, skipping
+// what .gitignore files say to ignore
+type fileWalker struct {
+	root  string
+	mu    sync.Mutex
+	files []string // relative to root
+	done  bool
+	stop  chan struct{}
+}
+
+func startFileWalker(root string) *fileWalker {
+	w := &fileWalker{root: root, stop: make(chan struct{})}
+	go w.walk()
+	return w
+}
+
+// snapshot returns the files found so far and whether that's all
+func (w *fileWalker) snapshot() ([]string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.files[:len(w.files):len(w.files)], w.done
+}
+
+// close stops the walk, if it's still going
+func (w *fileWalker) close() {
+	close(w.stop)
+}
+
+func (w *fileWalker) walk() {
+	var batch []string
+	lastFlush := time.Now()
+	flush := func() {
+		w.mu.Lock()
+		w.files = append(w.files, batch...)
+		w.mu.Unlock()
+		batch = batch[:0]
+		lastFlush = time.Now()
+		editorWakeUp()
+	}
+	walkProjectFiles(w.root, w.stop, func(rel string) {
+		batch = append(batch, rel)
+		if len(batch) >= 1000 || time.Since(lastFlush) > 50*time.Millisecond {
+			flush()
+		}
+	})
+	w.mu.Lock()
+	w.done = true
+	w.mu.Unlock()
+	flush()
+}
+
+// walkProjectFiles calls fn with every file under root (relative to
+// it) that .gitignore files don't say to ignore, until stop is closed
+func walkProjectFiles(root string, stop <-chan struct{}, fn func(rel string)) {
+	var rules []ignoreRule
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		select {
+		case <-stop:
+			return filepath.SkipAll
+		default:
+		}
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && (d.Name() == ".git" || isIgnored(rules, rel, true)) {
+				return filepath.SkipDir
+			}
+			if rel == "." {
+				rel = ""
+			}
+			rules = append(rules, readGitignore(path, rel)...)
+			return nil
+		}
+		if d.Type().IsRegular() && !isIgnored(rules, rel, false) {
+			fn(rel)
+		}
+		return nil
+	})
+}
+
+// ignoreRule is a pattern from a .gitignore file
+type ignoreRule struct {
+	base     string // the directory of the .gitignore, relative to the root
+	pattern  string
+	negate   bool // `!pattern`, the path is not ignored after all
+	dirOnly  bool // `pattern/`, only matches directories
+	anchored bool // the pattern has a `/`, it's matched against the whole path
+}
+
+// readGitignore reads the rules of dir/.gitignore, rel is dir relative
+// to the root
+func readGitignore(dir string, rel string) []ignoreRule {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	var rules []ignoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: rel}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// isIgnored reports whether the path rel (relative to the root) is
+// ignored. Like git, the last matching rule wins.
+func isIgnored(rules []ignoreRule, rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.match(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	if !r.anchored {
+		// matches the name at any depth
+		rel = rel[strings.LastIndexByte(rel, '/')+1:]
+	}
+	return globMatch(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// globMatch matches path segments against pattern segments, where a
+// `**` segment matches any number of segments
+func globMatch(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if globMatch(pattern[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], segs[0])
+	return err == nil && ok && globMatch(pattern[1:], segs[1:])
+}
+
+/***** minibuffer *****/
+
+// minibuffer is a single line of editable input, it's what
+// editorPrompt reads input with
+type minibuffer struct {
+	chars  []rune
+	cursor int // index into chars
+}
+
+// the text last killed in a minibuffer, C-Y yanks it back
+var minibufferKill []rune
+
+// promptCursorX is the cursor column in the message bar while a prompt
+// is active, -1 otherwise
+var promptCursorX = -1
+
+func (mb *minibuffer) String() string {
+	return string(mb.chars)
+}
+
+// set replaces the input with s, the cursor goes to the end
+func (mb *minibuffer) set(s string) {
+	mb.chars = []rune(s)
+	mb.cursor = len(mb.chars)
+}
+
+// insert inserts text at the cursor. The input is a single line, so
+// newlines are dropped.
+func (mb *minibuffer) insert(text []rune) {
+	text = slices.DeleteFunc(slices.Clone(text), func(c rune) bool {
+		return c == '\r' || c == '\n'
+	})
+	mb.chars = slices.Insert(mb.chars, mb.cursor, text...)
+	mb.cursor += len(text)
+}
+
+// kill deletes chars[from:to] and remembers it for C-Y
+func (mb *minibuffer) kill(from, to int) {
+	if from >= to {
+		return
+	}
+	minibufferKill = slices.Clone(mb.chars[from:to])
+	mb.chars = slices.Delete(mb.chars, from, to)
+	mb.cursor = from
+}
+
+// wordForward returns the end of the word after the cursor
+func (mb *minibuffer) wordForward() int {
+	i := mb.cursor
+	for i < len(mb.chars) && wordClass(mb.chars[i]) == WORD_SEP {
+		i++
+	}
+	if i < len(mb.chars) {
+		class := wordClass(mb.chars[i])
+		for i < len(mb.chars) && wordClass(mb.chars[i]) == class {
+			i++
+		}
+	}
+	return i
+}
+
+// wordBackward returns the start of the word before the cursor
+func (mb *minibuffer) wordBackward() int {
+	i := mb.cursor
+	for i > 0 && wordClass(mb.chars[i-1]) == WORD_SEP {
+		i--
+	}
+	if i > 0 {
+		class := wordClass(mb.chars[i-1])
+		for i > 0 && wordClass(mb.chars[i-1]) == class {
+			i--
+		}
+	}
+	return i
+}
+
+// handleKey applies an editing key to the input, it reports whether
+// the key was one
+func (mb *minibuffer) handleKey(ev tb.Event) bool {
+	if ev.Mod&tb.ModAlt != 0 {
+		switch {
+		case ev.Ch == 'f':
+			mb.cursor = mb.wordForward()
+		case ev.Ch == 'b':
+			mb.cursor = mb.wordBackward()
+		case ev.Ch == 'd':
+			mb.kill(mb.cursor, mb.wordForward())
+		case ev.Key == tb.KeyBackspace2 || ev.Key == tb.KeyBackspace:
+			mb.kill(mb.wordBackward(), mb.cursor)
+		default:
+			return false
+		}
+		return true
+	}
+	if ev.Ch != 0 {
+		mb.insert([]rune{ev.Ch})
+		return true
+	}
+	switch ev.Key {
+	case tb.KeySpace:
+		mb.insert([]rune{' '})
+	case tb.KeyBackspace2, tb.KeyBackspace:
+		if mb.cursor > 0 {
+			mb.chars = slices.Delete(mb.chars, mb.cursor-1, mb.cursor)
+			mb.cursor--
+		}
+	case tb.KeyDelete, tb.KeyCtrlD:
+		if mb.cursor < len(mb.chars) {
+			mb.chars = slices.Delete(mb.chars, mb.cursor, mb.cursor+1)
+		}
+	case tb.KeyHome, tb.KeyCtrlA:
+		mb.cursor = 0
+	case tb.KeyEnd, tb.KeyCtrlE:
+		mb.cursor = len(mb.chars)
+	case tb.KeyArrowLeft, tb.KeyCtrlB:
+		mb.cursor = max(mb.cursor-1, 0)
+	case tb.KeyArrowRight, tb.KeyCtrlF:
+		mb.cursor = min(mb.cursor+1, len(mb.chars))
+	case tb.KeyCtrlK:
+		mb.kill(mb.cursor, len(mb.chars))
+	case tb.KeyCtrlU:
+		mb.kill(0, mb.cursor)
+	case tb.KeyCtrlW:
+		mb.kill(mb.wordBackward(), mb.cursor)
+	case tb.KeyCtrlY:
+		mb.insert(minibufferKill)
+	default:
+		return false
+	}
+	return true
+}
+
+/***** state *****/
+
+// the kinds of prompt history
+const (
+	HIST_SEARCH      = "search"
+	HIST_SAVE_AS     = "save-as"
+	HIST_GOTO_LINE   = "goto-line"
+	HIST_FIND_FILE   = "find-file"
+	HIST_GREP        = "grep"
+	HIST_COMMAND     = "command"
+	HIST_GOTO_OFFSET = "goto-offset"
+	HIST_HEX_SEARCH  = "hex-search"
+	HISTORY_MAX      = 100 // the most entries kept per kind
+)
+
+// editorState is what we keep across sessions, in stateFilePath()
+type editorState struct {
+	History map[string][]string `json:"history"`
+	Recent  []recentFile        `json:"recent"`  // the most recent last
+	Session []string            `json:"session"` // the files open at the last exit
+}
+
+// recentFile is a recently opened file and where we were in it
+type recentFile struct {
+	Path      string `json:"path"` // absolute
+	CursorX   int    `json:"cursor_x"`
+	CursorY   int    `json:"cursor_y"`
+	RowOffset int    `json:"row_offset"`
+	ColOffset int    `json:"col_offset"`
+}
+
+// the most recent files kept
+const RECENT_MAX = 50
+
+var state = editorState{History: map[string][]string{}}
+
+// stateFilePath returns $XDG_STATE_HOME/gkilo/state.json, falling back
+// to ~/.local/state like the XDG spec says
+func stateFilePath() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "gkilo", "state.json")
+}
+
+// editorLoadState loads the state of the last session, a missing or
+// broken state file just means starting afresh
+func editorLoadState() {
+	data, err := os.ReadFile(stateFilePath())
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		logger.Printf("[WARN] broken state file %v: %v", stateFilePath(), err)
+	}
+	if state.History == nil {
+		state.History = map[string][]string{}
+	}
+}
+
+func editorSaveState() {
+	path := stateFilePath()
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = os.WriteFile(path, data, 0644)
+		}
+	}
+	if err != nil {
+		logger.Printf("[WARN] can't save state to %v: %v", path, err)
+	}
+}
+
+// editorRecordRecent moves the file of buffer b to the end of the
+// recent files, along with b's cursor and scroll position
+func editorRecordRecent(b *editorConf) {
+	if b.filename == "" || b.isListing() {
+		return
+	}
+	abs, err := filepath.Abs(b.filename)
+	if err != nil {
+		return
+	}
+	recent := slices.DeleteFunc(state.Recent, func(r recentFile) bool {
+		return r.Path == abs
+	})
+	recent = append(recent, recentFile{
+		Path:      abs,
+		CursorX:   b.cursorX,
+		CursorY:   b.cursorY,
+		RowOffset: b.rowOffset,
+		ColOffset: b.colOffset,
+	})
+	if len(recent) > RECENT_MAX {
+		recent = recent[len(recent)-RECENT_MAX:]
+	}
+	state.Recent = recent
+}
+
+// editorRestorePosition moves the cursor of the current buffer to
+// where it was when its file was last open
+func editorRestorePosition() {
+	abs, err := filepath.Abs(E.filename)
+	if err != nil {
+		return
+	}
+	i := slices.IndexFunc(state.Recent, func(r recentFile) bool {
+		return r.Path == abs
+	})
+	if i < 0 {
+		return
+	}
+	// the file may have changed since, editorSetPosition clamps
+	r := state.Recent[i]
+	editorSetPosition(r.CursorY, r.CursorX, r.RowOffset, r.ColOffset)
+}
+
+// editorRecentFiles picks a recent file to visit
+func editorRecentFiles() {
+	var paths []string
+	for i := len(state.Recent) - 1; i >= 0; i-- {
+		paths = append(paths, state.Recent[i].Path)
+	}
+	picked := editorPick("Recent file: %s", "", func() ([]string, bool) {
+		return paths, true
+	})
+	if picked != "" {
+		editorVisitFile(picked)
+	}
+}
+
+// editorSaveSession remembers the open files, and where we were in
+// them, for the next session
+func editorSaveSession() {
+	state.Session = nil
+	for _, b := range buffers {
+		editorRecordRecent(b)
+		if abs, err := filepath.Abs(b.filename); err == nil && b.filename != "" && !b.isListing() {
+			state.Session = append(state.Session, abs)
+		}
+	}
+	editorSaveState()
+}
+
+// editorRestoreSession reopens the files that were open at the last
+// exit
+func editorRestoreSession() {
+	for _, path := range state.Session {
+		if _, err := os.Stat(path); err == nil {
+			editorVisitFile(path)
+		}
+	}
+}
+
+// editorAddHistory appends input to the history of a kind of prompt,
+// moving it to the end if it's already there
+func editorAddHistory(kind string, input string) {
+	if kind == "" || input == "" {
+		return
+	}
+	hist := slices.DeleteFunc(state.History[kind], func(s string) bool {
+		return s == input
+	})
+	hist = append(hist, input)
+	if len(hist) > HISTORY_MAX {
+		hist = hist[len(hist)-HISTORY_MAX:]
+	}
+	state.History[kind] = hist
+	editorSaveState()
+}
+
+/***** input *****/
+
+const (
+	BRACKETED_PASTE_ON  = "\x1b[?2004h"
+	BRACKETED_PASTE_OFF = "\x1b[?2004l"
+	PASTE_START         = "\x1b[200~"
+	PASTE_END           = "\x1b[201~"
+	FOCUS_REPORTING_ON  = "\x1b[?1004h"
+	FOCUS_REPORTING_OFF = "\x1b[?1004l"
+	FOCUS_IN            = "\x1b[I"
+	FOCUS_OUT           = "\x1b[O"
+	// EventPaste is the type of an editorEvent carrying a bracketed paste
+	EventPaste = tb.EventNone + 1
+	// EventFocus is the type of an editorEvent sent when the terminal
+	// gets the focus
+	EventFocus = tb.EventNone + 2
+)
+
+// editorEvent is a termbox event, plus the pasted text if the event
+// is an EventPaste
+type editorEvent struct {
+	tb.Event
+	paste []rune
+}
+
+// interruptPending is set while an interrupt from editorWakeUp is on
+// its way
+var interruptPending atomic.Bool
+
+// editorInterrupted takes note that an interrupt has arrived, and quits
+// if it was sent by a signal
+func editorInterrupted() {
+	interruptPending.Store(false)
+	if quitRequested.Load() {
+		editorExit(1, "")
+	}
+}
+
+// editorWakeUp makes editorReadEvent return an EventInterrupt, so that
+// the screen gets redrawn with what background work has produced. It
+// never blocks, unlike tb.Interrupt.
+func editorWakeUp() {
+	if interruptPending.CompareAndSwap(false, true) {
+		go tb.Interrupt()
+	}
+}
+
+// This function is often use
+func tbprint(x, y int, fg, bg tb.Attribute, msg string) {
+	for _, c := range msg {
+		tb.SetCell(x, y, c, fg, bg)
+		x += runewidth.RuneWidth(c)
+	}
+}
+
+const (
+	SEPS = ",.()+-/*=~%<>[];，；。：（）"
+)
+
+/***** syntax highlighting *****/
+
+// MAX_HL_ROWS_PER_FRAME bounds the rows highlighted before a refresh
+const MAX_HL_ROWS_PER_FRAME = 2000
+
+// hasRunePrefix is strings.HasPrefix(string(s), prefix), without
+// converting all of s
+func hasRunePrefix(s []rune, prefix string) bool {
+	i := 0
+	for _, c := range prefix {
+		if i >= len(s) || s[i] != c {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+func isSeparator(c rune) bool {
+	return unicode.IsSpace(c) || strings.ContainsRune(SEPS, c)
+}
+
+// editorUpdateSyntax highlights erow after an edit. If that changes
+// whether it ends inside a comment, the rows after it are highlighted
+// again as they're shown.
+func editorUpdateSyntax(erow *editorRow) {
+	inComment := E.syntax != nil && erow.idx > 0 && E.row(erow.idx-1).hlOpenComment
+	if editorHighlightRow(erow, inComment) {
+		editorInvalidateSyntax(erow.idx + 1)
+	}
+}
+
+// editorHighlightRow computes erow.hl, starting inside a comment if
+// inComment. It reports whether where the row ends changed.
+func editorHighlightRow(erow *editorRow, inComment bool) bool {
+	erow.hlStart, erow.hlDone = inComment, true
+	erow.version = nextRowVersion()
+	if erow.hl == nil {
+		erow.hl = make([]editorHighlight, erow.rsize)
+	}
+	// make erow.hl as big as rsize
+	if erow.rsize < len(erow.hl) {
+		erow.hl = erow.hl[:erow.rsize]
+	} else if erow.rsize > len(erow.hl) {
+		erow.hl = append(erow.hl, make([]editorHighlight, erow.rsize-len(erow.hl))...)
+	}
+	// memset to default color first
+	for i := 0; i < len(erow.hl); i++ {
+		erow.hl[i] = HL_NORMAl
+	}
+	if E.syntax == nil {
+		return false
+	}
+
+	keywords := E.syntax.keywords
+	scs := E.syntax.singlelineCommentStart
+	mcs := E.syntax.multilineCommentStart
+	mce := E.syntax.multilineCommentEnd
+	var i int
+	preSep := true
+	// used to indicate whether in a string currently, also used to
+	// store the quotes (" or ')
+	inStr := rune(0)
+	for i = 0; i < erow.rsize; {
+		var prevHL editorHighlight
+		if i > 0 {
+			prevHL = erow.hl[i-1]
+		} else {
+			prevHL = HL_NORMAl
+		}
+
+		// inStr == rune(0) means not in a string
+		// comment
+		if scs != "" && inStr == rune(0) && !inComment {
+			if hasRunePrefix(erow.renderChars[i:], scs) {
+				for j := i; j < erow.rsize; j++ { // make hl[i..] HL_COMMENT
+					erow.hl[j] = HL_COMMENT
+				}
+				break
+			}
+		}
+		if mcs != "" && mce != "" && inStr == rune(0) { // not in str
+			if inComment {
+				erow.hl[i] = HL_MLCOMMENT
+				if hasRunePrefix(erow.renderChars[i:], mce) { // we met the end of ml_comment
+					for j := i; j < i+len(mce); j++ {
+						erow.hl[j] = HL_MLCOMMENT
+					}
+					i += len(mce)
+					preSep = true
 					inComment = false
 					continue
 				} else {
 					i++
 					continue
 				}
-			} else if strings.HasPrefix(string(erow.renderChars[i:]), mcs) { // we met the opening of ml_comment
-				// logger.Printf("renderChars: %+v\n", string(erow.renderChars[i:]))
-				for j := i; j < i+len(mcs); j++ {
-					erow.hl[j] = HL_MLCOMMENT
+			} else if hasRunePrefix(erow.renderChars[i:], mcs) { // we met the opening of ml_comment
+				// logger.Printf("renderChars: %+v\n", string(erow.renderChars[i:]))
+				for j := i; j < i+len(mcs); j++ {
+					erow.hl[j] = HL_MLCOMMENT
+				}
+				i += len(mcs)
+				inComment = true
+				continue
+			}
+		}
+		char := erow.renderChars[i]
+		// string
+		if E.syntax.flags&HL_HIGHLIGHT_STRINGS != 0 {
+			if inStr != rune(0) { // in a string
+				erow.hl[i] = HL_STRING
+				// take care of escaped quotes
+				if char == '\\' && i+1 < erow.rsize { // it's a `\`
+					erow.hl[i+1] = HL_STRING
+					i += 2
+					continue
+				}
+				if char == inStr {
+					inStr = rune(0) // met the ending of string, reset `inStr`
+				}
+				i++
+				preSep = true
+				continue
+			} else { // not in a string
+				if char == '"' || char == '\'' {
+					erow.hl[i] = HL_STRING
+					inStr = char
+					i++
+					continue
+				}
+			}
+		}
+		// number
+		if E.syntax.flags&HL_HIGHLIGHT_NUMBERS != 0 {
+			if (unicode.IsDigit(char) && (preSep || prevHL == HL_NUMBER)) || (char == '.' && prevHL == HL_NUMBER) {
+				erow.hl[i] = HL_NUMBER
+				i++
+				preSep = false
+				continue
+			}
+		}
+		// keywords
+		if preSep {
+			var foundKeyword bool
+			for _, keyword := range keywords {
+				var isKw2 bool
+				if strings.HasSuffix(keyword, "|") {
+					keyword = keyword[:len(keyword)-1] // remove trailing pipe `|`
+					isKw2 = true
+				}
+				// pre is sep && keyword match && (we met lineEnd || next char is sep also)
+				if hasRunePrefix(erow.renderChars[i:], keyword) &&
+					(i+len(keyword) >= erow.rsize ||
+						isSeparator(erow.renderChars[i+len(keyword)])) {
+					for j := i; j < i+len(keyword); j++ {
+						if isKw2 {
+							erow.hl[j] = HL_KEYWORD2
+						} else {
+							erow.hl[j] = HL_KEYWORD1
+						}
+					}
+					i += len(keyword)
+					foundKeyword = true
+					break
+				}
+			}
+			if foundKeyword {
+				preSep = false
+				continue
+			}
+		}
+		preSep = isSeparator(char)
+		i++
+	}
+	changed := erow.hlOpenComment != inComment
+	erow.hlOpenComment = inComment
+	return changed
+}
+
+// editorInvalidateSyntax marks the highlighting from row rowIdx on as
+// possibly out of date
+func editorInvalidateSyntax(rowIdx int) {
+	E.hlValid = min(E.hlValid, rowIdx)
+}
+
+// editorSyncSyntax walks the rows from E.hlValid up to row to, and
+// highlights those not highlighted from where the row before them
+// ends, at most budget of them. It reports whether it got to row to.
+func editorSyncSyntax(to, budget int) bool {
+	if E.pieces != nil {
+		// a large file isn't highlighted
+		return true
+	}
+	for ; E.hlValid < to; E.hlValid++ {
+		erow := E.row(E.hlValid)
+		inComment := E.hlValid > 0 && E.row(E.hlValid-1).hlOpenComment
+		if erow.hlDone && erow.hlStart == inComment {
+			continue
+		}
+		if budget == 0 {
+			return false
+		}
+		budget--
+		editorHighlightRow(erow, inComment)
+	}
+	return true
+}
+
+// editorHighlightScreen brings the highlighting of the rows on the
+// screen up to date. It highlights at most MAX_HL_ROWS_PER_FRAME rows
+// before the screen per refresh. If that's not enough, the screen is
+// highlighted from a guess for now, and the rest is done in the next
+// refreshes.
+func editorHighlightScreen() {
+	last := min(E.rowOffset+E.screenRows, E.numRows)
+	if editorSyncSyntax(last, MAX_HL_ROWS_PER_FRAME) {
+		return
+	}
+	for i := max(E.rowOffset, E.hlValid); i < last; i++ {
+		erow := E.row(i)
+		inComment := i > 0 && E.row(i-1).hlOpenComment
+		if !erow.hlDone || erow.hlStart != inComment {
+			editorHighlightRow(erow, inComment)
+		}
+	}
+	editorWakeUp()
+}
+
+/***** overlays *****/
+
+// overlaySpan highlights renderChars[start:end] of a row on top of the
+// syntax highlighting in hl
+type overlaySpan struct {
+	start int
+	end   int
+	hl    editorHighlight
+}
+
+// editorOverlays returns the overlay spans for this refresh, keyed by
+// row. They're recomputed every time, so an edit never leaves a stale
+// one behind, and recomputing the syntax never clobbers them.
+func editorOverlays() map[int][]overlaySpan {
+	overlays := make(map[int][]overlaySpan)
+	editorSearchOverlays(overlays)
+	for _, b := range editorBracketHighlights() {
+		idx := editorRowCxToRenderIdx(E.row(b.row), b.cx)
+		overlays[b.row] = append(overlays[b.row], overlaySpan{idx, idx + 1, b.hl})
+	}
+	return overlays
+}
+
+// overlayHL returns the highlight at render index idx of a row with
+// the given overlay spans, where the syntax says hl. Later spans win.
+func overlayHL(spans []overlaySpan, idx int, hl editorHighlight) editorHighlight {
+	for _, span := range spans {
+		if idx >= span.start && idx < span.end {
+			hl = span.hl
+		}
+	}
+	return hl
+}
+
+/***** brackets *****/
+
+// the farthest (in rows) we look for a matching bracket
+const MAX_BRACKET_SCAN_ROWS = 5000
+
+// bracketPos is the position of a bracket as a row and an index into
+// its rawChars
+type bracketPos struct {
+	row int
+	cx  int
+	hl  editorHighlight
+}
+
+// bracketPartner returns the partner of bracket c, and whether it's
+// found by searching forward
+func bracketPartner(c rune) (rune, bool) {
+	switch c {
+	case '(':
+		return ')', true
+	case '[':
+		return ']', true
+	case '{':
+		return '}', true
+	case ')':
+		return '(', false
+	case ']':
+		return '[', false
+	case '}':
+		return '{', false
+	}
+	return 0, false
+}
+
+// editorRowIsCode reports whether renderChars[renderIdx] of erow is
+// neither in a string nor in a comment, according to erow.hl
+func editorRowIsCode(erow *editorRow, renderIdx int) bool {
+	switch erow.hl[renderIdx] {
+	case HL_STRING, HL_COMMENT, HL_MLCOMMENT:
+		return false
+	}
+	return true
+}
+
+// editorBracketAtCursor returns the bracket under the cursor or,
+// failing that, the one before it
+func editorBracketAtCursor() (bracketPos, bool) {
+	if E.cursorY >= E.numRows {
+		return bracketPos{}, false
+	}
+	erow := E.row(E.cursorY)
+	for _, cx := range []int{E.cursorX, E.cursorX - 1} {
+		if cx < 0 || cx >= erow.size {
+			continue
+		}
+		if partner, _ := bracketPartner(erow.rawChars[cx]); partner == 0 {
+			continue
+		}
+		if editorRowIsCode(erow, editorRowCxToRenderIdx(erow, cx)) {
+			return bracketPos{row: E.cursorY, cx: cx}, true
+		}
+	}
+	return bracketPos{}, false
+}
+
+// editorFindMatchingBracket returns the partner of the bracket at b,
+// skipping brackets in strings and comments. The rows below the screen
+// may not be highlighted yet, at most budget of them are. If the
+// partner may be past those, it reports that it isn't done, and the
+// next call goes on from there.
+func editorFindMatchingBracket(b bracketPos, budget int) (m bracketPos, found, done bool) {
+	c := E.row(b.row).rawChars[b.cx]
+	partner, forward := bracketPartner(c)
+	step := 1
+	if !forward {
+		step = -1
+	}
+	synced := !forward || editorSyncSyntax(min(b.row+MAX_BRACKET_SCAN_ROWS+1, E.numRows), budget)
+	depth := 0
+	for row := b.row; row >= 0 && row < E.numRows && abs(row-b.row) <= MAX_BRACKET_SCAN_ROWS; row += step {
+		erow := E.row(row)
+		if !synced && row >= E.hlValid && !erow.hlDone {
+			return bracketPos{}, false, false
+		}
+		// index into renderChars of every rune
+		renderIdx := make([]int, erow.size)
+		for i, idx := 0, 0; i < erow.size; i++ {
+			renderIdx[i] = idx
+			if erow.rawChars[i] == '\t' {
+				idx += KILO_TAB_STOP
+			} else {
+				idx++
+			}
+		}
+		cx := 0
+		if !forward {
+			cx = erow.size - 1
+		}
+		if row == b.row {
+			cx = b.cx
+		}
+		for ; cx >= 0 && cx < erow.size; cx += step {
+			ch := erow.rawChars[cx]
+			if (ch != c && ch != partner) || !editorRowIsCode(erow, renderIdx[cx]) {
+				continue
+			}
+			if ch == c {
+				depth++
+			} else {
+				depth--
+			}
+			if depth == 0 {
+				return bracketPos{row: row, cx: cx}, true, true
+			}
+		}
+	}
+	return bracketPos{}, false, true
+}
+
+// editorBracketHighlights returns the bracket at the cursor and its
+// partner as HL_BRACKET, or just the bracket as HL_UNMATCHED_BRACKET
+// if it has no partner. The search for the partner highlights no more
+// rows per refresh than the screen does, nothing is returned until
+// it's done.
+func editorBracketHighlights() []bracketPos {
+	b, ok := editorBracketAtCursor()
+	if !ok {
+		return nil
+	}
+	m, ok, done := editorFindMatchingBracket(b, MAX_HL_ROWS_PER_FRAME)
+	if !done {
+		editorWakeUp()
+		return nil
+	}
+	if !ok {
+		b.hl = HL_UNMATCHED_BRACKET
+		return []bracketPos{b}
+	}
+	b.hl, m.hl = HL_BRACKET, HL_BRACKET
+	return []bracketPos{b, m}
+}
+
+// editorJumpToMatchingBracket moves the cursor to the partner of the
+// bracket at the cursor
+func editorJumpToMatchingBracket() {
+	b, ok := editorBracketAtCursor()
+	if !ok {
+		editorSetStatusMsg("No bracket at the cursor")
+		return
+	}
+	// a key press may take the time to highlight every row in reach
+	m, ok, _ := editorFindMatchingBracket(b, MAX_BRACKET_SCAN_ROWS)
+	if !ok {
+		editorSetStatusMsg("Unbalanced bracket")
+		return
+	}
+	E.cursorY, E.cursorX = m.row, m.cx
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+/***** directory browser *****/
+
+// rows before the first entry of a directory buffer, ie, the
+// directory's own name
+const DIRED_HEADER_ROWS = 1
+
+// dirEntry is an entry of a directory buffer
+type dirEntry struct {
+	name  string
+	isDir bool
+}
+
+// editorOpenDir lists dir in the current buffer, one entry per row,
+// like `ls -l` does
+func editorOpenDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return err
+	}
+	E.rows = nil
+	E.numRows = 0
+	// a refresh rebuilds the rows, which the listing would refuse
+	E.dirPath = ""
+	E.dirEntries = nil
+	E.filename = dir
+	E.syntax = &DIRED_SYNTAX
+
+	editorInsertRow(0, []rune("  "+dir+":"))
+	if parent, err := os.Stat(filepath.Dir(dir)); err == nil && dir != filepath.Dir(dir) {
+		editorDiredInsertEntry("..", parent)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil { // removed since ReadDir
+			continue
+		}
+		editorDiredInsertEntry(entry.Name(), info)
+	}
+	E.dirPath = dir
+	E.modified = false
+	return nil
+}
+
+func editorDiredInsertEntry(name string, info os.FileInfo) {
+	display := name
+	if info.IsDir() {
+		display += "/"
+	}
+	line := fmt.Sprintf("  %s %10d %s %s", info.Mode(), info.Size(),
+		info.ModTime().Format("2006-01-02 15:04"), display)
+	editorInsertRow(E.numRows, []rune(line))
+	E.dirEntries = append(E.dirEntries, dirEntry{name: name, isDir: info.IsDir()})
+}
+
+// editorDiredEntry returns the entry at the cursor
+func editorDiredEntry() (dirEntry, bool) {
+	i := E.cursorY - DIRED_HEADER_ROWS
+	if i < 0 || i >= len(E.dirEntries) {
+		return dirEntry{}, false
+	}
+	return E.dirEntries[i], true
+}
+
+// editorDiredRefresh lists the directory again, keeping the cursor
+// where it was as far as possible
+func editorDiredRefresh() {
+	cy := E.cursorY
+	if err := editorOpenDir(E.dirPath); err != nil {
+		editorSetStatusMsg("Can't list %s: %v", E.dirPath, err)
+		return
+	}
+	E.cursorY = min(cy, E.numRows-1)
+	E.cursorX = 0
+}
+
+// editorDiredProcessKey handles the keys of a directory buffer, it
+// reports whether the key was one. Any key that would edit the listing
+// is swallowed.
+func editorDiredProcessKey(key tb.Key, ch rune) bool {
+	entry, onEntry := editorDiredEntry()
+	switch {
+	case key == tb.KeyEnter || ch == 'f':
+		if !onEntry {
+			break
+		}
+		path := filepath.Join(E.dirPath, entry.name)
+		if !entry.isDir {
+			editorVisitFile(path)
+			break
+		}
+		editorResetBuffer()
+		if err := editorOpenDir(path); err != nil {
+			editorSetStatusMsg("Can't list %s: %v", path, err)
+		}
+	case ch == '^':
+		parent := filepath.Dir(E.dirPath)
+		editorResetBuffer()
+		if err := editorOpenDir(parent); err != nil {
+			editorSetStatusMsg("Can't list %s: %v", parent, err)
+		}
+	case ch == 'g':
+		editorDiredRefresh()
+	case ch == 'c', ch == '+':
+		prompt := "Create file: %s"
+		if ch == '+' {
+			prompt = "Create directory: %s"
+		}
+		name := editorPrompt(prompt, "", nil, nil)
+		if name == "" {
+			break
+		}
+		path := filepath.Join(E.dirPath, name)
+		var err error
+		if ch == '+' {
+			err = os.Mkdir(path, 0755)
+		} else {
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err == nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			editorSetStatusMsg("Can't create %s: %v", name, err)
+		}
+		editorDiredRefresh()
+	case ch == 'R':
+		if !onEntry || entry.name == ".." {
+			break
+		}
+		prompt := "Rename " + strings.ReplaceAll(entry.name, "%", "%%") + " to: %s"
+		newName := expandHome(editorPrompt(prompt, "", nil, completePath))
+		if newName == "" {
+			break
+		}
+		if !filepath.IsAbs(newName) {
+			newName = filepath.Join(E.dirPath, newName)
+		}
+		// os.Rename would replace it without a word
+		if _, err := os.Lstat(newName); err == nil && !editorConfirm(newName+" exists, overwrite it?") {
+			break
+		}
+		if err := os.Rename(filepath.Join(E.dirPath, entry.name), newName); err != nil {
+			editorSetStatusMsg("Can't rename %s: %v", entry.name, err)
+		}
+		editorDiredRefresh()
+	case ch == 'D':
+		if !onEntry || entry.name == ".." {
+			break
+		}
+		path := filepath.Join(E.dirPath, entry.name)
+		if !editorConfirm("Delete " + entry.name + "?") {
+			break
+		}
+		err := os.Remove(path)
+		if err != nil && entry.isDir && editorConfirm(entry.name+" is not empty, delete everything in it?") {
+			err = os.RemoveAll(path)
+		}
+		if err != nil {
+			editorSetStatusMsg("Can't delete %s: %v", entry.name, err)
+		}
+		editorDiredRefresh()
+	case ch != 0, key == tb.KeySpace, key == tb.KeyTab, key == tb.KeyBackspace2,
+		key == tb.KeyDelete, key == tb.KeyCtrlL:
+		// a listing is not for editing
+	default:
+		return false
+	}
+	return true
+}
+
+/***** grep *****/
+
+// rows before the first match of a grep results buffer, ie, what was
+// searched for
+const GREP_HEADER_ROWS = 1
+
+// GREP_PROGRESS_INTERVAL is how often the number of files searched is
+// shown
+const GREP_PROGRESS_INTERVAL = 200 * time.Millisecond
+
+// grepMatch is a match listed in a grep results buffer
+type grepMatch struct {
+	file string // absolute
+	row  int
+	cx   int
+}
+
+var (
+	grepBuffer  *editorConf      // the last grep results buffer, for M-g n/p
+	grepCurrent int         = -1 // index into grepBuffer.grepMatches
+)
+
+// editorIsListing reports whether the current buffer is a listing
+// (of a directory or grep results) rather than text to edit. The
+// builders of a listing only mark it as one once they've filled it,
+// editorRefuseEdit would turn them away otherwise.
+func editorIsListing() bool {
+	return E.isListing()
+}
+
+func (b *editorConf) isListing() bool {
+	return b.dirPath != "" || b.grepPattern != ""
+}
+
+// editorGrep reads a regexp and lists its matches in every file under
+// the project root, in a new buffer
+func editorGrep() {
+	pattern := editorPrompt("Grep (regexp): %s", HIST_GREP, nil, nil)
+	if pattern == "" {
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		editorSetStatusMsg("Bad regexp: %v", err)
+		return
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		editorSetStatusMsg("Can't find the project root: %v", err)
+		return
+	}
+	root := findProjectRoot(cwd)
+	matches, ok := editorRunGrep(root, re)
+	if !ok {
+		editorSetStatusMsg("Grep cancelled")
+		return
+	}
+
+	editorNewBuffer()
+	E.title = "*grep*"
+	E.syntax = &GREP_SYNTAX
+	editorInsertRow(0, []rune(fmt.Sprintf("grep %q in %s: %d matches", pattern, root, len(matches))))
+	for _, m := range matches {
+		rel, _ := filepath.Rel(root, m.match.file)
+		editorInsertRow(E.numRows, []rune(fmt.Sprintf("%s:%d:%s", rel, m.match.row+1, m.line)))
+		E.grepMatches = append(E.grepMatches, m.match)
+	}
+	E.grepPattern = pattern
+	E.modified = false
+	E.cursorY = min(GREP_HEADER_ROWS, E.numRows-1)
+	grepBuffer = E
+	grepCurrent = -1
+}
+
+// editorRunGrep searches root for re in the background, showing how
+// many files have been searched, while C-G cancels the search. It
+// reports whether the search finished.
+func editorRunGrep(root string, re *regexp.Regexp) ([]grepResult, bool) {
+	stop := make(chan struct{})
+	var searched atomic.Int64
+	done := make(chan []grepResult, 1)
+	go func() {
+		done <- grepFiles(root, re, stop, &searched)
+		editorWakeUp()
+	}()
+	// wake up now and then to show the progress
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		ticker := time.NewTicker(GREP_PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				editorWakeUp()
+			case <-finished:
+				return
+			}
+		}
+	}()
+	for {
+		editorSetStatusMsg("Searching %s... %d files (C-G cancels)", root, searched.Load())
+		editorRefreshScreen()
+		select {
+		case matches := <-done:
+			return matches, true
+		default:
+		}
+		switch ev := editorReadEvent(); {
+		case ev.Type == tb.EventKey && ev.Key == tb.KeyCtrlG:
+			close(stop)
+			<-done
+			return nil, false
+		case ev.Type == tb.EventResize:
+			editorResize()
+		}
+	}
+}
+
+type grepResult struct {
+	match grepMatch
+	line  string
+}
+
+// grepFiles searches every file under root for re, a file per
+// goroutine at a time, until stop is closed, counting the files in
+// searched. The matches are ordered by file and row.
+func grepFiles(root string, re *regexp.Regexp, stop <-chan struct{}, searched *atomic.Int64) []grepResult {
+	paths := make(chan string)
+	results := make(chan []grepResult)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				if res := grepFile(path, re); len(res) > 0 {
+					results <- res
+				}
+				searched.Add(1)
+			}
+		}()
+	}
+	go func() {
+		walkProjectFiles(root, stop, func(rel string) {
+			paths <- filepath.Join(root, rel)
+		})
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+
+	var all []grepResult
+	for res := range results {
+		all = append(all, res...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].match.file != all[j].match.file {
+			return all[i].match.file < all[j].match.file
+		}
+		return all[i].match.row < all[j].match.row
+	})
+	return all
+}
+
+// grepFile returns the first match of re on every line of a file.
+// Binary files are skipped.
+func grepFile(path string, re *regexp.Regexp) []grepResult {
+	data, err := os.ReadFile(path)
+	if err != nil || bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil
+	}
+	var res []grepResult
+	for row, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		loc := re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		res = append(res, grepResult{
+			match: grepMatch{file: path, row: row, cx: utf8.RuneCountInString(line[:loc[0]])},
+			line:  line,
+		})
+	}
+	return res
+}
+
+// editorGrepProcessKey handles the keys of a grep results buffer, it
+// reports whether the key was one. Any key that would edit the results
+// is swallowed.
+func editorGrepProcessKey(key tb.Key, ch rune) bool {
+	switch {
+	case key == tb.KeyEnter:
+		i := E.cursorY - GREP_HEADER_ROWS
+		if i >= 0 && i < len(E.grepMatches) {
+			grepBuffer = E
+			grepCurrent = i
+			editorVisitGrepMatch(E.grepMatches[i])
+		}
+	case ch != 0, key == tb.KeySpace, key == tb.KeyTab, key == tb.KeyBackspace2,
+		key == tb.KeyDelete, key == tb.KeyCtrlL:
+		// the results are not for editing
+	default:
+		return false
+	}
+	return true
+}
+
+// editorNextGrepMatch visits the next (dir 1) or previous (dir -1)
+// match of the last grep, from any buffer
+func editorNextGrepMatch(dir int) {
+	if grepBuffer == nil || !slices.Contains(buffers, grepBuffer) || len(grepBuffer.grepMatches) == 0 {
+		editorSetStatusMsg("No grep matches")
+		return
+	}
+	next := grepCurrent + dir
+	if next < 0 || next >= len(grepBuffer.grepMatches) {
+		editorSetStatusMsg("No more grep matches")
+		return
+	}
+	grepCurrent = next
+	// keep the results buffer in step
+	grepBuffer.cursorY = GREP_HEADER_ROWS + grepCurrent
+	grepBuffer.cursorX = 0
+	editorVisitGrepMatch(grepBuffer.grepMatches[grepCurrent])
+	editorSetStatusMsg("Match %d of %d", grepCurrent+1, len(grepBuffer.grepMatches))
+}
+
+func editorVisitGrepMatch(m grepMatch) {
+	if !editorVisitFile(m.file) {
+		return
+	}
+	E.cursorY = min(m.row, E.numRows)
+	E.cursorX = 0
+	if E.cursorY < E.numRows {
+		E.cursorX = min(m.cx, E.row(E.cursorY).size)
+	}
+}
+
+/***** external changes *****/
+
+// how often open files are checked for changes by someone else
+const DISK_CHECK_INTERVAL = 2 * time.Second
+
+// diskInfo is what a file looked like on disk
+type diskInfo struct {
+	modTime time.Time
+	size    int64
+	hash    [32]byte // sha256 of the content
+}
+
+// editorUpdateDiskInfo records that data is what's now on disk for the
+// current buffer
+func editorUpdateDiskInfo(data []byte) {
+	if fi, err := os.Stat(E.filename); err == nil {
+		E.disk = diskInfo{modTime: fi.ModTime(), size: fi.Size(), hash: sha256.Sum256(data)}
+	}
+}
+
+// editorDiskChanged reports whether the file of buffer b has been
+// changed on disk since we last read or wrote it. The mtime and size
+// are checked first, so the file is only read if they changed.
+func editorDiskChanged(b *editorConf) bool {
+	if b.filename == "" || b.isListing() || b.disk.modTime.IsZero() {
+		return false
+	}
+	fi, err := os.Stat(b.filename)
+	if err != nil {
+		// a deleted file is written back on save
+		return false
+	}
+	if fi.ModTime().Equal(b.disk.modTime) && fi.Size() == b.disk.size {
+		return false
+	}
+	// hashing all of a large file on every check is too slow
+	if b.pieces != nil {
+		return true
+	}
+	hash, err := fileHash(b.filename)
+	if err != nil {
+		return false
+	}
+	if hash == b.disk.hash {
+		// only touched, remember the new mtime
+		b.disk.modTime, b.disk.size = fi.ModTime(), fi.Size()
+		return false
+	}
+	return true
+}
+
+var (
+	watchMu      sync.Mutex
+	watchedFiles []watchedFile // what the disk watcher looks at
+	diskChanged  atomic.Bool   // the disk watcher saw a file change
+)
+
+// watchedFile is an open file, and the versions of it that are known
+type watchedFile struct {
+	name       string
+	disk, kept diskInfo
+}
+
+// sameStat reports whether d and o have the same mtime and size
+func (d diskInfo) sameStat(o diskInfo) bool {
+	return d.modTime.Equal(o.modTime) && d.size == o.size
+}
+
+// editorWatchFiles tells the disk watcher which files are open
+func editorWatchFiles() {
+	var files []watchedFile
+	for _, b := range buffers {
+		if b.filename != "" && !b.isListing() && !b.disk.modTime.IsZero() {
+			files = append(files, watchedFile{b.filename, b.disk, b.diskKept})
+		}
+	}
+	watchMu.Lock()
+	watchedFiles = files
+	watchMu.Unlock()
+}
+
+// watchDisk looks at the mtime and size of the open files every
+// DISK_CHECK_INTERVAL, and wakes the editor up once per change it sees,
+// for editorCheckDisk to find out what changed
+func watchDisk() {
+	reported := map[string]diskInfo{}
+	for range time.Tick(DISK_CHECK_INTERVAL) {
+		watchMu.Lock()
+		files := watchedFiles
+		watchMu.Unlock()
+		for _, f := range files {
+			fi, err := os.Stat(f.name)
+			if err != nil {
+				continue
+			}
+			now := diskInfo{modTime: fi.ModTime(), size: fi.Size()}
+			if now.sameStat(f.disk) || now.sameStat(f.kept) || now.sameStat(reported[f.name]) {
+				continue
+			}
+			reported[f.name] = now
+			diskChanged.Store(true)
+			editorWakeUp()
+		}
+	}
+}
+
+// editorCheckDisk looks for files changed on disk. Unmodified buffers
+// are reverted silently, for the current buffer with unsaved changes
+// the user gets to choose, once per change on disk. Large files are
+// never read again behind the user's back, they're often logs that
+// keep growing.
+func editorCheckDisk() {
+	cur := E
+	for _, b := range buffers {
+		if b == cur || b.modified || b.pieces != nil || !editorDiskChanged(b) {
+			continue
+		}
+		E = b
+		editorReloadBuffer()
+	}
+	E = cur
+
+	if !editorDiskChanged(E) {
+		return
+	}
+	if E.pieces != nil {
+		editorSetStatusMsg("File changed on disk, saving offers to reload it")
+		return
+	}
+	if !E.modified {
+		editorReloadBuffer()
+		editorSetStatusMsg("Reverted buffer from disk")
+		return
+	}
+	hash, _ := fileHash(E.filename)
+	if hash == E.diskKept.hash {
+		return
+	}
+	switch editorChoose("File changed on disk, buffer has unsaved changes: [r]eload, [k]eep or [d]iff?", "rkd") {
+	case 'r':
+		editorReloadBuffer()
+	case 'd':
+		editorDiffWithDisk()
+	default:
+		E.diskKept = diskInfo{hash: hash}
+		if fi, err := os.Stat(E.filename); err == nil {
+			E.diskKept.modTime, E.diskKept.size = fi.ModTime(), fi.Size()
+		}
+	}
+}
+
+// fileHash returns the sha256 of a file, without reading all of it
+// into memory
+func fileHash(name string) ([32]byte, error) {
+	var sum [32]byte
+	f, err := os.Open(name)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return sum, err
+	}
+	hash.Sum(sum[:0])
+	return sum, nil
+}
+
+// editorReloadBuffer reads the file of the current buffer again,
+// keeping the cursor and scroll position as far as possible
+func editorReloadBuffer() {
+	filename, readOnly := E.filename, E.readOnly
+	cy, cx, rowOffset, colOffset := E.cursorY, E.cursorX, E.rowOffset, E.colOffset
+	editorResetBuffer()
+	if err := editorOpen(filename); err != nil {
+		editorSetStatusMsg("Can't reload %s: %v", filename, err)
+		return
+	}
+	E.readOnly = E.readOnly || readOnly
+	editorSetPosition(cy, cx, rowOffset, colOffset)
+}
+
+// editorSetPosition moves the cursor and scrolls, clamped to what the
+// current buffer has
+func editorSetPosition(cy, cx, rowOffset, colOffset int) {
+	E.cursorY = min(max(cy, 0), E.numRows)
+	E.cursorX = 0
+	if E.cursorY < E.numRows {
+		E.cursorX = min(max(cx, 0), E.row(E.cursorY).size)
+	}
+	E.rowOffset = min(max(rowOffset, 0), E.cursorY)
+	E.colOffset = max(colOffset, 0)
+}
+
+// editorDiffWithDisk shows how the current buffer differs from its
+// file on disk, in a new buffer
+func editorDiffWithDisk() {
+	tmp, err := os.CreateTemp("", "gkilo-*")
+	if err != nil {
+		editorSetStatusMsg("Can't diff: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if E.pieces != nil {
+		_, err = E.pieces.WriteTo(tmp)
+	} else {
+		_, err = tmp.Write(editorContent())
+	}
+	tmp.Close()
+	if err != nil {
+		editorSetStatusMsg("Can't diff: %v", err)
+		return
+	}
+	filename := E.filename
+	diskName := filename
+	if E.compression != nil {
+		// diff what the file has once decompressed
+		if diskName, err = decompressToTemp(filename, E.compression); err != nil {
+			editorSetStatusMsg("Can't diff: %v", err)
+			return
+		}
+		defer os.Remove(diskName)
+	}
+	out, err := exec.Command("diff", "-u", "--label", filename+" (disk)", "--label", filename+" (buffer)", diskName, tmp.Name()).Output()
+	// diff exits with 1 when the files differ
+	if exitErr, ok := err.(*exec.ExitError); err != nil && !(ok && exitErr.ExitCode() == 1) {
+		editorSetStatusMsg("Can't diff: %v", err)
+		return
+	}
+	editorNewBuffer()
+	E.title = "*diff*"
+	editorInsertText([]rune(string(out)))
+	E.modified = false
+	E.cursorX, E.cursorY = 0, 0
+}
+
+/***** large files *****/
+
+const (
+	LARGE_FILE_SIZE = 64 << 20 // files at least this big are opened as large files
+	PIECE_BLOCK     = 64 << 10 // a large file is read in blocks of this size
+	MAX_BLOCK_CACHE = 64       // the number of blocks a piece table keeps in memory
+	MAX_ROW_CACHE   = 4096     // the number of rows a large file buffer keeps between refreshes
+)
+
+// piece is a run of bytes, of the file or of what's been added since
+type piece struct {
+	added  bool // in pieceTable.add, instead of the file
+	start  int64
+	length int64
+	lines  int // the number of newlines in it
+}
+
+// pieceNode is a node of a treap of pieces, in the order of the
+// content. A node knows the bytes and newlines under it, so finding an
+// offset or a line is O(log n).
+type pieceNode struct {
+	p           piece
+	prio        uint32
+	left, right *pieceNode
+	size        int64
+	lines       int
+}
+
+// pieceTable holds the content of a large file buffer. The file is
+// never read whole: its blocks are read when they're needed, and edits
+// only add pieces. Every line ends with a newline, like rows are
+// written.
+type pieceTable struct {
+	file   *os.File
+	add    []byte
+	root   *pieceNode
+	blocks map[int64][]byte // the blocks of the file read lately
+	err    error            // the first error reading the file
+	crlf   bool             // the first line ends with "\r\n", new lines do too
+}
+
+func newPieceNode(p piece) *pieceNode {
+	return &pieceNode{p: p, prio: rand.Uint32(), size: p.length, lines: p.lines}
+}
+
+func (n *pieceNode) treeSize() int64 {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *pieceNode) treeLines() int {
+	if n == nil {
+		return 0
+	}
+	return n.lines
+}
+
+func (n *pieceNode) update() {
+	n.size = n.left.treeSize() + n.p.length + n.right.treeSize()
+	n.lines = n.left.treeLines() + n.p.lines + n.right.treeLines()
+}
+
+// pieceMerge joins two treaps, all of a comes before b
+func pieceMerge(a, b *pieceNode) *pieceNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a.right = pieceMerge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = pieceMerge(a, b.left)
+	b.update()
+	return b
+}
+
+// newPieceTable reads f once, to count its lines, writing what's read
+// to w too
+func newPieceTable(f *os.File, w io.Writer) (*pieceTable, error) {
+	pt := &pieceTable{file: f, blocks: make(map[int64][]byte)}
+	buf := make([]byte, PIECE_BLOCK)
+	var off int64
+	var last byte
+	seenNewline := false
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			if k := bytes.IndexByte(buf[:n], '\n'); k >= 0 && !seenNewline {
+				seenNewline = true
+				pt.crlf = k > 0 && buf[k-1] == '\r' || k == 0 && last == '\r'
+			}
+			// a block is a piece to begin with, so a piece of the file
+			// is always inside one block
+			p := piece{start: off, length: int64(n), lines: bytes.Count(buf[:n], []byte{'\n'})}
+			pt.root = pieceMerge(pt.root, newPieceNode(p))
+			off += int64(n)
+			last = buf[n-1]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if off > 0 && last != '\n' {
+		pt.insert(off, pt.newline())
+	}
+	return pt, nil
+}
+
+// newline returns what lines written to pt end with
+func (pt *pieceTable) newline() []byte {
+	if pt.crlf {
+		return []byte("\r\n")
+	}
+	return []byte{'\n'}
+}
+
+func (pt *pieceTable) close() {
+	pt.file.Close()
+}
+
+func (pt *pieceTable) size() int64 {
+	return pt.root.treeSize()
+}
+
+func (pt *pieceTable) lineCount() int {
+	return pt.root.treeLines()
+}
+
+// block returns the n-th block of the file
+func (pt *pieceTable) block(n int64) []byte {
+	if blk, ok := pt.blocks[n]; ok {
+		return blk
+	}
+	if len(pt.blocks) >= MAX_BLOCK_CACHE {
+		clear(pt.blocks)
+	}
+	blk := make([]byte, PIECE_BLOCK)
+	k, err := pt.file.ReadAt(blk, n*PIECE_BLOCK)
+	if err != nil && err != io.EOF && pt.err == nil {
+		pt.err = err
+	}
+	pt.blocks[n] = blk[:k]
+	return blk[:k]
+}
+
+func (pt *pieceTable) pieceBytes(p piece) []byte {
+	if p.added {
+		return pt.add[p.start : p.start+p.length]
+	}
+	blk := pt.block(p.start / PIECE_BLOCK)
+	off := p.start % PIECE_BLOCK
+	if int64(len(blk)) < off+p.length {
+		// the file couldn't be read, or it's been truncated
+		return make([]byte, p.length)
+	}
+	return blk[off : off+p.length]
+}
+
+// split splits the treap n into the bytes before off and the rest
+func (pt *pieceTable) split(n *pieceNode, off int64) (*pieceNode, *pieceNode) {
+	if n == nil {
+		return nil, nil
+	}
+	leftSize := n.left.treeSize()
+	switch {
+	case off <= leftSize:
+		l, r := pt.split(n.left, off)
+		n.left = r
+		n.update()
+		return l, n
+	case off >= leftSize+n.p.length:
+		l, r := pt.split(n.right, off-leftSize-n.p.length)
+		n.right = l
+		n.update()
+		return n, r
+	}
+	k := off - leftSize
+	head := piece{added: n.p.added, start: n.p.start, length: k}
+	head.lines = bytes.Count(pt.pieceBytes(head), []byte{'\n'})
+	tail := piece{added: n.p.added, start: n.p.start + k, length: n.p.length - k, lines: n.p.lines - head.lines}
+	return pieceMerge(n.left, newPieceNode(head)), pieceMerge(newPieceNode(tail), n.right)
+}
+
+func (pt *pieceTable) insert(off int64, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	p := piece{added: true, start: int64(len(pt.add)), length: int64(len(data)), lines: bytes.Count(data, []byte{'\n'})}
+	pt.add = append(pt.add, data...)
+	l, r := pt.split(pt.root, off)
+	pt.root = pieceMerge(pieceMerge(l, newPieceNode(p)), r)
+}
+
+func (pt *pieceTable) delete(off, length int64) {
+	l, r := pt.split(pt.root, off)
+	_, r = pt.split(r, length)
+	pt.root = pieceMerge(l, r)
+}
+
+// lineStart returns the offset of line i, or the size if there are
+// only i lines
+func (pt *pieceTable) lineStart(i int) int64 {
+	var off int64
+	for n := pt.root; n != nil && i > 0; {
+		if i <= n.left.treeLines() {
+			n = n.left
+			continue
+		}
+		i -= n.left.treeLines()
+		off += n.left.treeSize()
+		if i <= n.p.lines {
+			data := pt.pieceBytes(n.p)
+			idx := 0
+			for ; i > 0; i-- {
+				k := bytes.IndexByte(data[idx:], '\n')
+				if k < 0 {
+					break
 				}
-				i += len(mcs)
-				inComment = true
-				continue
+				idx += k + 1
+			}
+			return off + int64(idx)
+		}
+		i -= n.p.lines
+		off += n.p.length
+		n = n.right
+	}
+	return off
+}
+
+// read returns length bytes from off
+func (pt *pieceTable) read(off, length int64) []byte {
+	buf := make([]byte, 0, length)
+	pt.collect(pt.root, off, off+length, &buf)
+	return buf
+}
+
+// collect appends the bytes [from, to) of the treap n to buf
+func (pt *pieceTable) collect(n *pieceNode, from, to int64, buf *[]byte) {
+	if n == nil || from >= to {
+		return
+	}
+	start := n.left.treeSize()
+	end := start + n.p.length
+	if from < start {
+		pt.collect(n.left, from, min(to, start), buf)
+	}
+	if from < end && to > start {
+		data := pt.pieceBytes(n.p)
+		*buf = append(*buf, data[max(from-start, 0):min(to, end)-start]...)
+	}
+	if to > end {
+		pt.collect(n.right, max(from-end, 0), to-end, buf)
+	}
+}
+
+// line returns line i, without its newline
+func (pt *pieceTable) line(i int) []byte {
+	start := pt.lineStart(i)
+	return pt.read(start, pt.lineStart(i+1)-1-start)
+}
+
+// setLine replaces the text of line i, which keeps its line ending
+func (pt *pieceTable) setLine(i int, text []byte) {
+	start := pt.lineStart(i)
+	end := pt.lineStart(i+1) - 1
+	if end > start && pt.read(end-1, 1)[0] == '\r' {
+		end--
+	}
+	pt.delete(start, end-start)
+	pt.insert(start, text)
+}
+
+func (pt *pieceTable) insertLine(i int, text []byte) {
+	pt.insert(pt.lineStart(i), append(text, pt.newline()...))
+}
+
+func (pt *pieceTable) deleteLine(i int) {
+	start := pt.lineStart(i)
+	pt.delete(start, pt.lineStart(i+1)-start)
+}
+
+// each calls fn with every piece of the content, in order
+func (pt *pieceTable) each(fn func(data []byte) error) error {
+	var stack []*pieceNode
+	for n := pt.root; n != nil || len(stack) > 0; {
+		if n != nil {
+			stack = append(stack, n)
+			n = n.left
+			continue
+		}
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if err := fn(pt.pieceBytes(n.p)); err != nil {
+			return err
+		}
+		if pt.err != nil {
+			return pt.err
+		}
+		n = n.right
+	}
+	return nil
+}
+
+// eachLine calls fn with every line, without its newline. The line is
+// only valid during the call.
+func (pt *pieceTable) eachLine(fn func(i int, line []byte)) error {
+	var carry []byte
+	i := 0
+	return pt.each(func(data []byte) error {
+		for {
+			k := bytes.IndexByte(data, '\n')
+			if k < 0 {
+				carry = append(carry, data...)
+				return nil
+			}
+			line := data[:k]
+			if len(carry) > 0 {
+				carry = append(carry, line...)
+				line = carry
+			}
+			fn(i, line)
+			i++
+			carry = carry[:0]
+			data = data[k+1:]
+		}
+	})
+}
+
+func (pt *pieceTable) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	err := pt.each(func(data []byte) error {
+		n, err := w.Write(data)
+		written += int64(n)
+		return err
+	})
+	return written, err
+}
+
+// row returns row i of the buffer. The rows of a large file are read
+// from its piece table when they're first needed.
+func (b *editorConf) row(i int) *editorRow {
+	if b.pieces == nil {
+		return b.rows[i]
+	}
+	if erow, ok := b.rowCache[i]; ok {
+		return erow
+	}
+	chars := []rune(string(bytes.TrimSuffix(b.pieces.line(i), []byte{'\r'})))
+	erow := &editorRow{idx: i, size: len(chars), rawChars: chars}
+	erow.renderChars = genRenderChars(chars)
+	erow.rsize = len(erow.renderChars)
+	erow.hl = make([]editorHighlight, erow.rsize)
+	erow.version = nextRowVersion()
+	b.rowCache[i] = erow
+	return erow
+}
+
+// editorDropRows forgets the rows of a large file from rowIdx on, after
+// a row is inserted or deleted there. The rows before it stay, as an
+// edit may still be holding one.
+func editorDropRows(rowIdx int) {
+	for i := range E.rowCache {
+		if i >= rowIdx {
+			delete(E.rowCache, i)
+		}
+	}
+}
+
+// editorTrimRowCache forgets the rows of a large file that aren't on
+// the screen, once there are too many of them
+func editorTrimRowCache() {
+	if len(E.rowCache) < MAX_ROW_CACHE {
+		return
+	}
+	for i := range E.rowCache {
+		if i < E.rowOffset || i >= E.rowOffset+E.screenRows {
+			delete(E.rowCache, i)
+		}
+	}
+}
+
+// editorOpenLarge opens a large file in the current buffer. Only its
+// newlines are counted up front, rows are read when they're shown.
+func editorOpenLarge(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	pt, err := newPieceTable(f, hash)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			E.disk = diskInfo{modTime: fi.ModTime(), size: fi.Size()}
+			hash.Sum(E.disk.hash[:0])
+		}
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	E.pieces = pt
+	E.rowCache = make(map[int]*editorRow)
+	E.numRows = pt.lineCount()
+	E.filename = fileName
+	E.modified = false
+	E.readOnly = !fileWritable(fileName)
+	editorSelectSyntaxHighlight()
+	editorRestorePosition()
+	editorRecordRecent(E)
+	editorSetStatusMsg("Large file, syntax highlighting is off")
+	return nil
+}
+
+// editorSaveLarge writes a large file buffer to a new file, which then
+// replaces the old one. The buffer still reads from the old one, so it
+// can't be overwritten in place.
+func editorSaveLarge() {
+	name, err := filepath.EvalSymlinks(E.filename)
+	if err != nil {
+		name = E.filename
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err == nil {
+		hash := sha256.New()
+		var n int64
+		n, err = E.pieces.WriteTo(io.MultiWriter(tmp, hash))
+		if fi, statErr := os.Stat(name); statErr == nil && err == nil {
+			err = tmp.Chmod(fi.Mode())
+		}
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), name)
+		}
+		if err == nil {
+			editorSetStatusMsg(fmt.Sprintf("%d bytes written to disk", n))
+			E.modified = false
+			if fi, err := os.Stat(name); err == nil {
+				E.disk = diskInfo{modTime: fi.ModTime(), size: fi.Size()}
+				hash.Sum(E.disk.hash[:0])
+			}
+			return
+		}
+		os.Remove(tmp.Name())
+	}
+	if os.IsPermission(err) && saveHelper != "" {
+		// a helper like `sudo tee` would overwrite the file in place
+		editorSetStatusMsg("Can't save! %v, and %s can't save a large file: the buffer still reads from it", err, saveHelper)
+		return
+	}
+	editorSetStatusMsg(fmt.Sprintf("Can't save! I/O error: %s", err.Error()))
+}
+
+// editorFindAllLarge is editorFindAll for a large file. It scans the
+// bytes, and only decodes the lines that may match.
+func editorFindAllLarge(query []rune) []searchMatch {
+	var matches []searchMatch
+	needle := []byte(string(query))
+	// spaces may match an expanded tab
+	quick := !slices.Contains(query, ' ')
+	E.pieces.eachLine(func(i int, line []byte) {
+		if quick && !bytes.Contains(line, needle) {
+			return
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		for _, idx := range runeIndexAll(genRenderChars([]rune(string(line))), query) {
+			matches = append(matches, searchMatch{i, idx})
+		}
+	})
+	return matches
+}
+
+/***** read-only buffers *****/
+
+// editorRefuseEdit reports whether the current buffer can't be edited,
+// being a listing, read-only or in hex mode, and tells the user so if
+// it can't
+func editorRefuseEdit() bool {
+	switch {
+	case editorIsListing():
+		editorSetStatusMsg("A listing can't be edited")
+	case E.readOnly:
+		editorSetStatusMsg("Buffer is read-only, C-X C-Q makes it writable")
+	case E.hexMode:
+		editorSetStatusMsg("Bytes can only be overwritten in hex mode")
+	default:
+		return false
+	}
+	return true
+}
+
+func editorToggleReadOnly() {
+	if editorIsListing() {
+		editorSetStatusMsg("A listing can't be edited")
+		return
+	}
+	E.readOnly = !E.readOnly
+	if E.readOnly {
+		editorSetStatusMsg("Buffer is read-only: SPC/b page, g/G go to the top/bottom, / searches")
+	} else {
+		editorSetStatusMsg("Buffer is writable")
+	}
+}
+
+// editorViewProcessKey handles the keys of a read-only buffer, which
+// move around like in less. It reports whether the key was one of
+// them.
+func editorViewProcessKey(key tb.Key, ch rune) bool {
+	switch {
+	case key == tb.KeySpace:
+		editorScrollPage(true)
+	case ch == 'b':
+		editorScrollPage(false)
+	case ch == 'g':
+		E.cursorY, E.cursorX = 0, 0
+	case ch == 'G':
+		E.cursorY, E.cursorX = E.numRows, 0
+	case ch == '/':
+		editorFind()
+	default:
+		return false
+	}
+	return true
+}
+
+/***** hex editor *****/
+
+const (
+	HEX_BYTES_PER_ROW = 16
+	HEX_COL           = 10                                // where the hex column starts in a row
+	HEX_ASCII_COL     = HEX_COL + HEX_BYTES_PER_ROW*3 + 3 // where the ASCII column starts, after " |"
+	BINARY_SNIFF_LEN  = 4096                              // the bytes looked at to tell if a file is binary
+)
+
+// isBinary guesses whether data, the start of a file, is binary. Text
+// has no NULs and few control characters, whatever its encoding.
+func isBinary(data []byte) bool {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	control := 0
+	for _, b := range data {
+		if b < 0x20 && !strings.ContainsRune("\t\n\r\f\b\x1b", rune(b)) {
+			control++
+		}
+	}
+	return control*10 > len(data)
+}
+
+// hexRow formats the row of a hex dump of data starting at off, like
+// `hexdump -C` does
+func hexRow(data []byte, off int) []rune {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%08x  ", off)
+	end := min(off+HEX_BYTES_PER_ROW, len(data))
+	for i := 0; i < HEX_BYTES_PER_ROW; i++ {
+		if off+i < end {
+			fmt.Fprintf(&b, "%02x ", data[off+i])
+		} else {
+			b.WriteString("   ")
+		}
+		if i == HEX_BYTES_PER_ROW/2-1 {
+			b.WriteByte(' ')
+		}
+	}
+	b.WriteString(" |")
+	for _, c := range data[off:end] {
+		if c < 0x20 || c >= 0x7f {
+			c = '.'
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('|')
+	return []rune(b.String())
+}
+
+// hexByteCol returns where the i-th byte of a row is in the hex column
+func hexByteCol(i int) int {
+	col := HEX_COL + i*3
+	if i >= HEX_BYTES_PER_ROW/2 {
+		col++
+	}
+	return col
+}
+
+// editorHexLoad shows data as a hex dump in the current buffer
+func editorHexLoad(data []byte) {
+	for off := 0; off < len(data); off += HEX_BYTES_PER_ROW {
+		editorInsertRow(E.numRows, hexRow(data, off))
+	}
+	E.hexData = data
+	E.hexMode = true
+}
+
+// editorHexCursor returns the byte under the cursor, which nibble of it
+// (0 for the high one), and whether the cursor is in the ASCII column
+func editorHexCursor() (off, nibble int, ascii bool) {
+	i := 0
+	switch cx := E.cursorX; {
+	case cx >= HEX_ASCII_COL:
+		i, ascii = cx-HEX_ASCII_COL, true
+	case cx >= HEX_COL:
+		j := cx - HEX_COL
+		// the extra space in the middle
+		if j >= HEX_BYTES_PER_ROW/2*3 {
+			j--
+		}
+		i, nibble = j/3, min(j%3, 1)
+	}
+	off = E.cursorY*HEX_BYTES_PER_ROW + min(i, HEX_BYTES_PER_ROW-1)
+	return max(min(off, len(E.hexData)-1), 0), nibble, ascii
+}
+
+// editorHexSetCursor puts the cursor on a nibble of the byte at off, or
+// on its character in the ASCII column
+func editorHexSetCursor(off, nibble int, ascii bool) {
+	off = max(min(off, len(E.hexData)-1), 0)
+	i := off % HEX_BYTES_PER_ROW
+	E.cursorY = off / HEX_BYTES_PER_ROW
+	if ascii {
+		E.cursorX = HEX_ASCII_COL + i
+	} else {
+		E.cursorX = hexByteCol(i) + nibble
+	}
+}
+
+// editorHexSetByte overwrites the byte at off
+func editorHexSetByte(off int, b byte) {
+	E.hexData[off] = b
+	erow := E.row(off / HEX_BYTES_PER_ROW)
+	erow.rawChars = hexRow(E.hexData, off-off%HEX_BYTES_PER_ROW)
+	erow.size = len(erow.rawChars)
+	editorUpdateRow(erow)
+	E.modified = true
+}
+
+// editorHexProcessKey handles the keys of a hex buffer: the motions go
+// by bytes, hex digits overwrite the nibble under the cursor, and in
+// the ASCII column, characters overwrite the byte. Tab goes from one
+// column to the other. It reports whether the key was one of them.
+func editorHexProcessKey(key tb.Key, ch rune) bool {
+	if len(E.hexData) == 0 {
+		return false
+	}
+	off, nibble, ascii := editorHexCursor()
+	switch {
+	case key == tb.KeyArrowLeft || key == tb.KeyCtrlB:
+		editorHexSetCursor(off-1, 0, ascii)
+	case key == tb.KeyArrowRight || key == tb.KeyCtrlF:
+		editorHexSetCursor(off+1, 0, ascii)
+	case key == tb.KeyArrowUp || key == tb.KeyCtrlP:
+		if off >= HEX_BYTES_PER_ROW {
+			editorHexSetCursor(off-HEX_BYTES_PER_ROW, nibble, ascii)
+		}
+	case key == tb.KeyArrowDown || key == tb.KeyCtrlN:
+		// the last row may be too short to go straight down
+		if off/HEX_BYTES_PER_ROW < (len(E.hexData)-1)/HEX_BYTES_PER_ROW {
+			editorHexSetCursor(off+HEX_BYTES_PER_ROW, nibble, ascii)
+		}
+	case key == tb.KeyHome || key == tb.KeyCtrlA:
+		editorHexSetCursor(off-off%HEX_BYTES_PER_ROW, 0, ascii)
+	case key == tb.KeyEnd || key == tb.KeyCtrlE:
+		editorHexSetCursor(off-off%HEX_BYTES_PER_ROW+HEX_BYTES_PER_ROW-1, 0, ascii)
+	case key == tb.KeyPgdn:
+		editorHexSetCursor(off+HEX_BYTES_PER_ROW*E.screenRows, nibble, ascii)
+	case key == tb.KeyPgup:
+		editorHexSetCursor(off-HEX_BYTES_PER_ROW*E.screenRows, nibble, ascii)
+	case key == tb.KeyTab:
+		editorHexSetCursor(off, 0, !ascii)
+	case ascii && (key == tb.KeySpace || ch >= 0x20 && ch < 0x7f):
+		if E.readOnly {
+			return editorRefuseEdit()
+		}
+		c := byte(ch)
+		if key == tb.KeySpace {
+			c = ' '
+		}
+		editorHexSetByte(off, c)
+		editorHexSetCursor(off+1, 0, true)
+	case !ascii && strings.ContainsRune("0123456789abcdefABCDEF", ch) && ch != 0:
+		if E.readOnly {
+			return editorRefuseEdit()
+		}
+		v, _ := strconv.ParseUint(string(ch), 16, 8)
+		b := E.hexData[off]
+		if nibble == 0 {
+			b = b&0x0f | byte(v)<<4
+			editorHexSetByte(off, b)
+			editorHexSetCursor(off, 1, false)
+		} else {
+			b = b&0xf0 | byte(v)
+			editorHexSetByte(off, b)
+			editorHexSetCursor(off+1, 0, false)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// editorHexGotoOffset reads an offset, in decimal or 0x hex, and moves
+// to the byte there
+func editorHexGotoOffset() {
+	input := editorPrompt("Goto offset: %s", HIST_GOTO_OFFSET, nil, nil)
+	if input == "" {
+		return
+	}
+	off, err := strconv.ParseInt(strings.TrimSpace(input), 0, 64)
+	if err != nil || off < 0 || off >= int64(len(E.hexData)) {
+		editorSetStatusMsg("Not an offset in the file: %s", input)
+		return
+	}
+	_, _, ascii := editorHexCursor()
+	editorHexSetCursor(int(off), 0, ascii)
+}
+
+// parseHexQuery parses what to search for in a hex buffer: hex digits,
+// eg, "de ad be ef", or a "quoted string"
+func parseHexQuery(query string) ([]byte, error) {
+	query = strings.TrimSpace(query)
+	if len(query) >= 2 && query[0] == '"' && query[len(query)-1] == '"' {
+		return []byte(query[1 : len(query)-1]), nil
+	}
+	return hex.DecodeString(strings.Join(strings.Fields(query), ""))
+}
+
+// editorHexFind reads bytes to search for, and moves to where they're
+// next found after the cursor, wrapping around at the end
+func editorHexFind() {
+	input := editorPrompt("Search bytes (hex or \"text\"): %s", HIST_HEX_SEARCH, nil, nil)
+	if input == "" {
+		return
+	}
+	needle, err := parseHexQuery(input)
+	if err != nil || len(needle) == 0 {
+		editorSetStatusMsg("Not hex digits nor a quoted string: %s", input)
+		return
+	}
+	off, _, ascii := editorHexCursor()
+	i := bytes.Index(E.hexData[min(off+1, len(E.hexData)):], needle)
+	if i >= 0 {
+		i += off + 1
+	} else if i = bytes.Index(E.hexData, needle); i < 0 {
+		editorSetStatusMsg("Not found: %s", input)
+		return
+	}
+	editorHexSetCursor(i, 0, ascii)
+	editorSetStatusMsg("Found at offset 0x%x", i)
+}
+
+/***** compressed files *****/
+
+// compression is a way of compressing files, told apart by the magic
+// bytes compressed files start with
+type compression struct {
+	name       string
+	magic      []byte
+	compress   func(data []byte) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+// MAX_MAGIC_LEN is the most bytes any magic of COMPRESSIONS has
+const MAX_MAGIC_LEN = 4
+
+// there's no zstd in the standard library, the zstd command does it
+var COMPRESSIONS = []*compression{
+	{
+		name:       "gzip",
+		magic:      []byte{0x1f, 0x8b},
+		compress:   gzipCompress,
+		decompress: gzipDecompress,
+	},
+	{
+		name:       "zstd",
+		magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		compress:   commandFilter("zstd", "-q", "-c"),
+		decompress: commandFilter("zstd", "-d", "-q", "-c"),
+	},
+}
+
+// detectCompression returns the compression of a file starting with
+// magic, nil if there's none
+func detectCompression(magic []byte) *compression {
+	for _, c := range COMPRESSIONS {
+		if bytes.HasPrefix(magic, c.magic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// sniffCompression returns the compression of the file name, nil if
+// there's none
+func sniffCompression(name string) *compression {
+	return detectCompression(sniffHead(name, MAX_MAGIC_LEN))
+}
+
+// sniffHead returns up to the first n bytes of the file name
+func sniffHead(name string, n int) []byte {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, n)
+	n, _ = io.ReadFull(f, head)
+	return head[:n]
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// commandFilter returns a function that runs data through a command
+func commandFilter(name string, args ...string) func(data []byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if msg := strings.TrimSpace(stderr.String()); err != nil && msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return out, err
+	}
+}
+
+// decompressToTemp writes what the file name has once decompressed to
+// a temporary file, and returns its name
+func decompressToTemp(name string, c *compression) (string, error) {
+	data, err := os.ReadFile(name)
+	if err == nil {
+		data, err = c.decompress(data)
+	}
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp("", "gkilo-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+/***** saving with a helper *****/
+
+// SAVE_HELPER_TIMEOUT is how long a save helper may go without asking
+// anything before it's killed
+const SAVE_HELPER_TIMEOUT = 30 * time.Second
+
+// promptSecret makes editorPrompt show the input as stars
+var promptSecret bool
+
+// editorPromptSecret reads a password in the message bar
+func editorPromptSecret(prompt string) string {
+	promptSecret = true
+	defer func() {
+		promptSecret = false
+	}()
+	return editorPrompt(strings.ReplaceAll(prompt, "%", "%%")+" %s", "", nil, nil)
+}
+
+// editorSaveWithHelper writes buffer to the file of the current buffer
+// through saveHelper, eg, `sudo tee`. What the helper asks on its
+// terminal, eg, a password, is asked in the message bar. The file is
+// read back afterwards, to make sure it has what was written.
+func editorSaveWithHelper(buffer []byte) {
+	args := append(strings.Fields(saveHelper), E.filename)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(buffer)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	tty, err := startWithPty(cmd)
+	if err != nil {
+		editorSetStatusMsg("Can't save with %s: %v", saveHelper, err)
+		return
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	prompts := make(chan string)
+	finished := make(chan struct{})
+	defer close(finished)
+	defer tty.Close()
+	go helperPrompts(tty, prompts, finished)
+	timeout := time.NewTimer(SAVE_HELPER_TIMEOUT)
+	defer timeout.Stop()
+	for err == nil {
+		select {
+		case prompt := <-prompts:
+			answer := editorPromptSecret(prompt)
+			if answer == "" {
+				cmd.Process.Kill()
+				<-done
+				editorSetStatusMsg("Save aborted")
+				return
 			}
+			tty.WriteString(answer + "\n")
+			timeout.Reset(SAVE_HELPER_TIMEOUT)
+			continue
+		case <-timeout.C:
+			cmd.Process.Kill()
+			<-done
+			err = fmt.Errorf("timed out")
+		case err = <-done:
 		}
-		char := erow.renderChars[i]
-		// string
-		if E.syntax.flags&HL_HIGHLIGHT_STRINGS != 0 {
-			if inStr != rune(0) { // in a string
-				erow.hl[i] = HL_STRING
-				// take care of escaped quotes
-				if char == '\\' && i+1 < erow.rsize { // it's a `\`
-					erow.hl[i+1] = HL_STRING
-					i += 2
-					continue
-				}
-				if char == inStr {
-					inStr = rune(0) // met the ending of string, reset `inStr`
-				}
-				i++
-				preSep = true
-				continue
-			} else { // not in a string
-				if char == '"' || char == '\'' {
-					erow.hl[i] = HL_STRING
-					inStr = char
-					i++
-					continue
-				}
+		break
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		editorSetStatusMsg("Can't save with %s: %s", saveHelper, msg)
+		return
+	}
+	switch hash, err := fileHash(E.filename); {
+	case err != nil:
+		E.modified = false
+		editorUpdateDiskInfo(buffer)
+		editorSetStatusMsg("%d bytes written with %s, but can't read them back: %v", len(buffer), saveHelper, err)
+	case hash != sha256.Sum256(buffer):
+		editorSetStatusMsg("Saved with %s, but the file differs from the buffer!", saveHelper)
+	default:
+		E.modified = false
+		editorUpdateDiskInfo(buffer)
+		editorSetStatusMsg("%d bytes written to disk with %s", len(buffer), saveHelper)
+	}
+}
+
+// helperPrompts reads what a save helper writes on its terminal, and
+// sends every line that looks like a question, eg, "Password:", to
+// prompts, until finished is closed
+func helperPrompts(tty *os.File, prompts chan<- string, finished <-chan struct{}) {
+	buf := make([]byte, 1024)
+	var line []byte
+	for {
+		n, err := tty.Read(buf)
+		line = append(line, buf[:n]...)
+		if i := bytes.LastIndexByte(line, '\n'); i >= 0 {
+			line = line[i+1:]
+		}
+		if prompt := strings.TrimSpace(string(line)); strings.HasSuffix(prompt, ":") {
+			line = nil
+			select {
+			case prompts <- prompt:
+			case <-finished:
+				return
 			}
 		}
-		// number
-		if E.syntax.flags&HL_HIGHLIGHT_NUMBERS != 0 {
-			if (unicode.IsDigit(char) && (preSep || prevHL == HL_NUMBER)) || (char == '.' && prevHL == HL_NUMBER) {
-				erow.hl[i] = HL_NUMBER
-				i++
-				preSep = false
+		if err != nil {
+			return
+		}
+	}
+}
+
+/***** shell commands *****/
+
+// SHELL_TIMEOUT is how long a shell command may run before it's killed
+const SHELL_TIMEOUT = 30 * time.Second
+
+// editorSetMark sets the mark at the cursor
+func editorSetMark() {
+	E.markSet, E.markY, E.markX = true, E.cursorY, E.cursorX
+	editorSetStatusMsg("Mark set")
+}
+
+// editorRegion returns the start and the end of the text between the
+// mark and the cursor, or of the whole buffer if the mark isn't set
+func editorRegion() (y1, x1, y2, x2 int) {
+	if E.numRows == 0 {
+		return 0, 0, 0, 0
+	}
+	if !E.markSet {
+		return 0, 0, E.numRows - 1, E.row(E.numRows - 1).size
+	}
+	// edits since the mark was set may have moved the end of the buffer
+	clamp := func(y, x int) (int, int) {
+		y = min(y, E.numRows-1)
+		return y, min(x, E.row(y).size)
+	}
+	y1, x1 = clamp(E.markY, E.markX)
+	y2, x2 = clamp(E.cursorY, E.cursorX)
+	if y2 < y1 || (y2 == y1 && x2 < x1) {
+		y1, x1, y2, x2 = y2, x2, y1, x1
+	}
+	return y1, x1, y2, x2
+}
+
+// editorRegionText returns the text between (y1, x1) and (y2, x2)
+func editorRegionText(y1, x1, y2, x2 int) []rune {
+	var text []rune
+	for y := y1; y <= y2 && y < E.numRows; y++ {
+		chars := E.row(y).rawChars
+		from, to := 0, len(chars)
+		if y == y1 {
+			from = x1
+		}
+		if y == y2 {
+			to = x2
+		}
+		text = append(text, chars[from:to]...)
+		if y < y2 {
+			text = append(text, '\n')
+		}
+	}
+	return text
+}
+
+// shellCommand runs command with the user's shell in dir, feeding it
+// input. A failure comes with what the command wrote to stderr.
+func shellCommand(ctx context.Context, command, dir string, input []byte) ([]byte, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	cmd.Dir = dir
+	// what the shell started may outlive it and keep stdout open
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("timed out after %v", SHELL_TIMEOUT)
+	case ctx.Err() == context.Canceled:
+		err = fmt.Errorf("cancelled")
+	case err != nil:
+		if msg := strings.Join(strings.Fields(stderr.String()), " "); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+	}
+	return out, err
+}
+
+// editorRunShell runs command in the directory of the current file,
+// for SHELL_TIMEOUT at most, while C-G cancels it
+func editorRunShell(command string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SHELL_TIMEOUT)
+	defer cancel()
+	dir := ""
+	if E.filename != "" {
+		dir = filepath.Dir(E.filename)
+	}
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := shellCommand(ctx, command, dir, input)
+		done <- result{out, err}
+		editorWakeUp()
+	}()
+	editorSetStatusMsg("Running %s... (C-G cancels)", command)
+	for {
+		editorRefreshScreen()
+		select {
+		case res := <-done:
+			return res.out, res.err
+		default:
+		}
+		switch ev := editorReadEvent(); {
+		case ev.Type == tb.EventKey && ev.Key == tb.KeyCtrlG:
+			cancel()
+		case ev.Type == tb.EventResize:
+			editorResize()
+		}
+	}
+}
+
+// editorShellCommand reads a command and runs it. Output of one line
+// is shown in the message bar, longer output in a new buffer.
+func editorShellCommand() {
+	command := editorPrompt("Shell command: %s", HIST_COMMAND, nil, nil)
+	if command == "" {
+		return
+	}
+	out, err := editorRunShell(command, nil)
+	if err != nil {
+		editorSetStatusMsg("%s failed: %v", command, err)
+		return
+	}
+	text := strings.TrimSuffix(string(out), "\n")
+	switch {
+	case text == "":
+		editorSetStatusMsg("(%s: no output)", command)
+	case !strings.Contains(text, "\n"):
+		editorSetStatusMsg("%s", text)
+	default:
+		editorNewBuffer()
+		E.title = "*shell output*"
+		editorInsertText([]rune(text))
+		E.modified = false
+		E.cursorX, E.cursorY = 0, 0
+	}
+}
+
+// editorFilterRegion reads a command, eg, `sort`, and replaces the
+// region, or the whole buffer if the mark isn't set, with what the
+// command outputs when given the region. Nothing is changed if the
+// command fails.
+func editorFilterRegion() {
+	if editorRefuseEdit() {
+		return
+	}
+	// the whole of a large file would be read in, and deleted row by row
+	if E.pieces != nil && !E.markSet {
+		editorSetStatusMsg("Large file, set the mark to filter a region of it")
+		return
+	}
+	command := editorPrompt("Filter through command: %s", HIST_COMMAND, nil, nil)
+	if command == "" {
+		return
+	}
+	y1, x1, y2, x2 := editorRegion()
+	input := string(editorRegionText(y1, x1, y2, x2))
+	if !E.markSet && E.numRows > 0 {
+		// as the file is saved
+		input += "\n"
+	}
+	out, err := editorRunShell(command, []byte(input))
+	if err != nil {
+		editorSetStatusMsg("%s failed, nothing changed: %v", command, err)
+		return
+	}
+	editorReplaceRegion(y1, x1, y2, x2, editorFilterOutput(input, string(out)))
+	E.markSet = false
+}
+
+// editorFilterOutput returns what replaces the input of a filter: its
+// output, without the newline the filter added at the end if the input
+// didn't end with one, or the newline that was the end of the buffer
+func editorFilterOutput(input, out string) []rune {
+	if strings.HasSuffix(out, "\n") && (!E.markSet || !strings.HasSuffix(input, "\n")) {
+		out = out[:len(out)-1]
+	}
+	return []rune(out)
+}
+
+// editorReplaceRegion replaces the text between (y1, x1) and (y2, x2)
+// with text, in one go, and leaves the cursor at the start of it
+func editorReplaceRegion(y1, x1, y2, x2 int, text []rune) {
+	if editorRefuseEdit() {
+		return
+	}
+	editorDelRegion(y1, x1, y2, x2)
+	E.cursorY, E.cursorX = y1, x1
+	editorInsertText(text)
+	E.cursorY, E.cursorX = y1, x1
+}
+
+/***** formatting *****/
+
+// FORMAT_TIMEOUT is how long a formatter may run before it's killed
+const FORMAT_TIMEOUT = 10 * time.Second
+
+// formatErrLine finds "file:line:" or "file:line:col:" in what a
+// formatter reports, eg, "<standard input>:3:1: expected ';'"
+var formatErrLine = regexp.MustCompile(`[^\s:]*:(\d+):(?:\d+:)?\s*`)
+
+// editorFormat pipes the current buffer through the formatter of its
+// file type, if it has one, and puts the result in the buffer. The
+// cursor stays on the same text.
+func editorFormat() error {
+	if !formatOnSave || E.syntax == nil || E.syntax.formatter == "" || E.readOnly || E.hexMode || E.pieces != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), FORMAT_TIMEOUT)
+	defer cancel()
+	in := editorRowsToBytes()
+	out, err := shellCommand(ctx, E.syntax.formatter, filepath.Dir(E.filename), in)
+	if err != nil {
+		msg := err.Error()
+		if m := formatErrLine.FindStringSubmatchIndex(msg); m != nil {
+			msg = "line " + msg[m[2]:m[3]] + ": " + msg[m[1]:]
+		}
+		return fmt.Errorf("%s: %s", strings.Fields(E.syntax.formatter)[0], msg)
+	}
+	if len(bytes.TrimSpace(out)) == 0 && len(bytes.TrimSpace(in)) > 0 {
+		// rather a broken formatter than an emptied buffer
+		return fmt.Errorf("%s: no output, the buffer is left as it is", strings.Fields(E.syntax.formatter)[0])
+	}
+	var lines [][]rune
+	if len(out) > 0 {
+		lines = splitLines([]rune(strings.TrimSuffix(string(out), "\n")))
+	}
+	editorReplaceRows(lines)
+	return nil
+}
+
+// editorReplaceRows makes lines the rows of the current buffer. Only
+// the rows that differ are replaced. As formatters mostly change
+// spaces, the cursor is kept on the same text by counting the runes
+// that aren't spaces before it.
+func editorReplaceRows(lines [][]rune) {
+	prefix := 0
+	for prefix < min(E.numRows, len(lines)) && slices.Equal(E.row(prefix).rawChars, lines[prefix]) {
+		prefix++
+	}
+	if prefix == E.numRows && prefix == len(lines) {
+		return
+	}
+	suffix := 0
+	for suffix < min(E.numRows, len(lines))-prefix &&
+		slices.Equal(E.row(E.numRows-1-suffix).rawChars, lines[len(lines)-1-suffix]) {
+		suffix++
+	}
+
+	oldY := E.cursorY
+	pastEnd := E.cursorY >= E.numRows
+	before := 0
+	for y := 0; y <= E.cursorY && y < E.numRows; y++ {
+		chars := E.row(y).rawChars
+		if y == E.cursorY {
+			chars = chars[:min(E.cursorX, len(chars))]
+		}
+		before += countNonSpace(chars)
+	}
+	// the cursor is in the indentation, it goes before the text after
+	// it, not after the text before it
+	lineStart := !pastEnd && countNonSpace(E.row(E.cursorY).rawChars[:min(E.cursorX, E.row(E.cursorY).size)]) == 0
+
+	for y := E.numRows - suffix - 1; y >= prefix; y-- {
+		editorDelRow(y)
+	}
+	for i, line := range lines[prefix : len(lines)-suffix] {
+		editorInsertRow(prefix+i, line)
+	}
+
+	if pastEnd {
+		E.cursorY, E.cursorX = E.numRows, 0
+	} else {
+		E.cursorY, E.cursorX = editorNonSpacePos(before, lineStart)
+	}
+	// and on the same line of the screen
+	E.rowOffset = max(E.rowOffset+E.cursorY-oldY, 0)
+}
+
+// editorNonSpacePos returns where the n-th rune that isn't a space is,
+// or, if before, the (n+1)-th one, or the end of the buffer if there
+// aren't that many
+func editorNonSpacePos(n int, before bool) (int, int) {
+	for y := 0; y < E.numRows; y++ {
+		for x, r := range E.row(y).rawChars {
+			if unicode.IsSpace(r) {
 				continue
 			}
-		}
-		// keywords
-		if preSep {
-			var foundKeyword bool
-			for _, keyword := range keywords {
-				var isKw2 bool
-				if strings.HasSuffix(keyword, "|") {
-					keyword = keyword[:len(keyword)-1] // remove trailing pipe `|`
-					isKw2 = true
-				}
-				// pre is sep && keyword match && (we met lineEnd || next char is sep also)
-				if strings.HasPrefix(string(erow.renderChars[i:]), keyword) &&
-					(i+len(keyword) >= erow.rsize ||
-						isSeparator(erow.renderChars[i+len(keyword)])) {
-					for j := i; j < i+len(keyword); j++ {
-						if isKw2 {
-							erow.hl[j] = HL_KEYWORD2
-						} else {
-							erow.hl[j] = HL_KEYWORD1
-						}
-					}
-					i += len(keyword)
-					foundKeyword = true
-					break
-				}
+			if n == 0 {
+				return y, x
 			}
-			if foundKeyword {
-				preSep = false
-				continue
+			n--
+			if n == 0 && !before {
+				return y, x + 1
 			}
 		}
-		preSep = isSeparator(char)
-		i++
 	}
-	changed := erow.hlOpenComment != inComment
-	erow.hlOpenComment = inComment
-	if changed && erow.idx+1 < E.numRows {
-		editorUpdateSyntax(E.rows[erow.idx+1])
+	if E.numRows == 0 {
+		return 0, 0
+	}
+	return E.numRows - 1, E.row(E.numRows - 1).size
+}
+
+// countNonSpace returns the number of runes of chars that aren't spaces
+func countNonSpace(chars []rune) int {
+	n := 0
+	for _, r := range chars {
+		if !unicode.IsSpace(r) {
+			n++
+		}
+	}
+	return n
+}
+
+/***** motions *****/
+
+const (
+	WORD_SEP = iota
+	WORD_ALNUM
+	WORD_CJK
+)
+
+// wordClass classifies a rune for word motions. A word is a run of
+// runes with the same non-WORD_SEP class, so that eg, "abc你好" is two
+// words.
+func wordClass(c rune) int {
+	switch {
+	case c == '_':
+		return WORD_ALNUM
+	case isSeparator(c) || unicode.IsPunct(c) || unicode.IsSymbol(c):
+		return WORD_SEP
+	case unicode.In(c, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+		return WORD_CJK
+	default:
+		return WORD_ALNUM
+	}
+}
+
+// editorForwardWordPos returns the position of the end of the word
+// after (cy, cx), crossing rows if needed
+func editorForwardWordPos(cy, cx int) (int, int) {
+	if cy >= E.numRows {
+		return cy, cx
+	}
+	// skip the separators, line ends count as separators
+	for {
+		erow := E.row(cy)
+		for cx < erow.size && wordClass(erow.rawChars[cx]) == WORD_SEP {
+			cx++
+		}
+		if cx < erow.size {
+			break
+		}
+		if cy+1 >= E.numRows {
+			return cy, erow.size
+		}
+		cy, cx = cy+1, 0
+	}
+	erow := E.row(cy)
+	class := wordClass(erow.rawChars[cx])
+	for cx < erow.size && wordClass(erow.rawChars[cx]) == class {
+		cx++
+	}
+	return cy, cx
+}
+
+// editorBackwardWordPos returns the position of the start of the word
+// before (cy, cx), crossing rows if needed
+func editorBackwardWordPos(cy, cx int) (int, int) {
+	if cy >= E.numRows {
+		if E.numRows == 0 {
+			return cy, cx
+		}
+		cy, cx = E.numRows-1, E.row(E.numRows-1).size
+	}
+	for {
+		erow := E.row(cy)
+		for cx > 0 && wordClass(erow.rawChars[cx-1]) == WORD_SEP {
+			cx--
+		}
+		if cx > 0 {
+			break
+		}
+		if cy == 0 {
+			return 0, 0
+		}
+		cy = cy - 1
+		cx = E.row(cy).size
+	}
+	erow := E.row(cy)
+	class := wordClass(erow.rawChars[cx-1])
+	for cx > 0 && wordClass(erow.rawChars[cx-1]) == class {
+		cx--
+	}
+	return cy, cx
+}
+
+// isBlankRow reports whether a row has nothing but whitespace,
+// blank rows separate paragraphs
+func isBlankRow(erow *editorRow) bool {
+	for _, c := range erow.rawChars {
+		if !unicode.IsSpace(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// editorForwardParagraph returns the blank row after the paragraph at
+// or after row cy
+func editorForwardParagraph(cy int) int {
+	for cy < E.numRows && isBlankRow(E.row(cy)) {
+		cy++
+	}
+	for cy < E.numRows && !isBlankRow(E.row(cy)) {
+		cy++
+	}
+	return cy
+}
+
+// editorBackwardParagraph returns the blank row before the paragraph
+// at or before row cy
+func editorBackwardParagraph(cy int) int {
+	cy = min(cy, E.numRows) - 1
+	for cy > 0 && isBlankRow(E.row(cy)) {
+		cy--
+	}
+	for cy > 0 && !isBlankRow(E.row(cy)) {
+		cy--
+	}
+	return max(cy, 0)
+}
+
+func editorGotoLine() {
+	if E.hexMode {
+		editorHexGotoOffset()
+		return
+	}
+	input := editorPrompt("Goto line: %s", HIST_GOTO_LINE, nil, nil)
+	if input == "" {
+		return
 	}
+	line, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil {
+		editorSetStatusMsg("Not a line number: %s", input)
+		return
+	}
+	// line numbers are 1-based, the last valid one is the empty
+	// line after the last row
+	E.cursorY = min(max(line-1, 0), E.numRows)
+	E.cursorX = 0
 }
 
 func editorSyntaxToColor(hl editorHighlight) tb.Attribute {
@@ -986,7 +5414,9 @@ func editorSyntaxToColor(hl editorHighlight) tb.Attribute {
 	case HL_NUMBER:
 		return tb.ColorRed
 	case HL_MATCH:
-		return tb.ColorLightBlue
+		return tb.ColorLightBlue | tb.AttrReverse
+	case HL_MATCH_OTHER:
+		return tb.ColorLightBlue | tb.AttrUnderline
 	case HL_STRING:
 		return tb.ColorMagenta
 	case HL_COMMENT, HL_MLCOMMENT:
@@ -995,6 +5425,10 @@ func editorSyntaxToColor(hl editorHighlight) tb.Attribute {
 		return tb.ColorYellow
 	case HL_KEYWORD2:
 		return tb.ColorGreen
+	case HL_BRACKET:
+		return tb.ColorLightGreen | tb.AttrBold
+	case HL_UNMATCHED_BRACKET:
+		return tb.ColorLightRed | tb.AttrBold | tb.AttrReverse
 	default:
 		return tb.ColorDefault
 	}
@@ -1002,7 +5436,14 @@ func editorSyntaxToColor(hl editorHighlight) tb.Attribute {
 
 func editorSelectSyntaxHighlight() {
 	E.syntax = nil
-	if E.filename == "" {
+	// the rows are highlighted again as they're shown
+	editorInvalidateSyntax(0)
+	for _, erow := range E.rows {
+		erow.hlDone = false
+	}
+	// highlighting would read all of a large file, and a hex dump isn't
+	// in the language of the file
+	if E.filename == "" || E.pieces != nil || E.hexMode {
 		return
 	}
 	parts := strings.Split(E.filename, ".")
@@ -1016,10 +5457,6 @@ func editorSelectSyntaxHighlight() {
 			isExt := strings.HasPrefix(m, ".")
 			if (isExt && fileExt == m[1:]) || (!isExt && strings.Contains(E.filename, m)) {
 				E.syntax = &hl
-				// update the syntax of every row
-				for i := 0; i < E.numRows; i++ {
-					editorUpdateSyntax(E.rows[i])
-				}
 				return
 			}
 		}
@@ -1,9 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	tb "github.com/nsf/termbox-go"
 )
 
 func testCxToRx(t *testing.T) {
@@ -96,3 +114,1029 @@ func TestPunct(t *testing.T) {
 	c := '。'
 	fmt.Printf("%c: %v\n", c, isSeparator(c))
 }
+
+func TestRelayout(t *testing.T) {
+	newTestEditor(strings.Repeat("x", 100), "short", "three")
+	E.cursorY, E.cursorX = 0, 90
+	editorSetScreenSize(80, 24)
+	editorScroll()
+	if E.colOffset != 11 {
+		t.Fatalf("unexpected colOffset: %d", E.colOffset)
+	}
+	// the cursor stays visible, so does the column offset
+	editorSetScreenSize(85, 24)
+	editorRelayout()
+	if E.colOffset != 11 {
+		t.Fatalf("colOffset reset to %d", E.colOffset)
+	}
+	editorSetScreenSize(50, 24)
+	editorRelayout()
+	if E.colOffset != 41 {
+		t.Fatalf("cursor out of view, colOffset %d", E.colOffset)
+	}
+	editorSetScreenSize(10, 1)
+	editorRelayout()
+	if E.screenRows != 1 || E.statusBarRowIdx != 0 || E.msgBarRowIdx != 0 {
+		t.Fatalf("unexpected layout: %d rows, bars at %d and %d", E.screenRows, E.statusBarRowIdx, E.msgBarRowIdx)
+	}
+	E.cursorY = 2
+	editorRelayout()
+	if E.rowOffset != 2 {
+		t.Fatalf("cursor row out of view, rowOffset %d", E.rowOffset)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	lines := splitLines([]rune("a\r\nb\rc\n"))
+	if len(lines) != 4 || string(lines[0]) != "a" || string(lines[2]) != "c" || len(lines[3]) != 0 {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+}
+
+// newTestEditor sets up E with the given lines as rows
+func newTestEditor(lines ...string) {
+	E = &editorConf{screenRows: 20, screenCols: 80, goalRx: -1}
+	logger = log.New(io.Discard, "", 0)
+	for _, line := range lines {
+		editorInsertRow(E.numRows, []rune(line))
+	}
+}
+
+func TestWordMotions(t *testing.T) {
+	newTestEditor("foo_bar, baz你好。", "", "  qux")
+	cy, cx := editorForwardWordPos(0, 0)
+	if cy != 0 || cx != 7 {
+		t.Fatalf("forward word: (%d, %d)", cy, cx)
+	}
+	cy, cx = editorForwardWordPos(0, 7)
+	if cy != 0 || cx != 12 {
+		t.Fatalf("forward word: (%d, %d)", cy, cx)
+	}
+	cy, cx = editorForwardWordPos(0, 14)
+	if cy != 2 || cx != 5 {
+		t.Fatalf("forward word across rows: (%d, %d)", cy, cx)
+	}
+	cy, cx = editorBackwardWordPos(2, 2)
+	if cy != 0 || cx != 12 {
+		t.Fatalf("backward word across rows: (%d, %d)", cy, cx)
+	}
+
+	editorDelRegion(0, 7, 2, 2)
+	if E.numRows != 1 || string(E.rows[0].rawChars) != "foo_barqux" {
+		t.Fatalf("unexpected rows after delete: %q", string(E.rows[0].rawChars))
+	}
+}
+
+func TestParagraphMotions(t *testing.T) {
+	newTestEditor("a", "b", "", "", "c", "d", "")
+	if cy := editorForwardParagraph(0); cy != 2 {
+		t.Fatalf("forward paragraph: %d", cy)
+	}
+	if cy := editorForwardParagraph(2); cy != 6 {
+		t.Fatalf("forward paragraph: %d", cy)
+	}
+	if cy := editorBackwardParagraph(5); cy != 3 {
+		t.Fatalf("backward paragraph: %d", cy)
+	}
+}
+
+func TestGoalColumn(t *testing.T) {
+	newTestEditor("\tabcdef", "ab", "你好世界", "abcdefgh")
+	E.cursorX = 3 // rx 6
+	editorMoveCursor(tb.KeyArrowDown)
+	if E.cursorX != 2 {
+		t.Fatalf("short row: cx = %d", E.cursorX)
+	}
+	editorMoveCursor(tb.KeyArrowDown)
+	if E.cursorX != 3 { // rx 6 is the start of 界
+		t.Fatalf("wide row: cx = %d", E.cursorX)
+	}
+	editorMoveCursor(tb.KeyArrowDown)
+	if E.cursorX != 6 {
+		t.Fatalf("goal column lost: cx = %d", E.cursorX)
+	}
+}
+
+func TestAutoIndent(t *testing.T) {
+	newTestEditor("  if (x) {}")
+	E.syntax = &HLDB[0]
+	E.cursorX = 10
+	editorInsertNewline()
+	rows := []string{}
+	for _, erow := range E.rows {
+		rows = append(rows, string(erow.rawChars))
+	}
+	if !slices.Equal(rows, []string{"  if (x) {", "      ", "  }"}) {
+		t.Fatalf("unexpected rows: %q", rows)
+	}
+	if E.cursorY != 1 || E.cursorX != 6 {
+		t.Fatalf("unexpected cursor: (%d, %d)", E.cursorY, E.cursorX)
+	}
+
+	E.cursorY, E.cursorX = 1, 6
+	editorInsertChar('}')
+	if got := string(E.rows[1].rawChars); got != "  }" {
+		t.Fatalf("closing bracket not dedented: %q", got)
+	}
+
+	// brackets in strings and comments don't count
+	for _, line := range []string{`s := "{`, `x // {`, `/* {`} {
+		newTestEditor("\t" + line)
+		E.syntax = &HLDB[0]
+		editorUpdateRow(E.rows[0])
+		E.cursorX = E.rows[0].size
+		editorInsertNewline()
+		if got := string(E.rows[1].rawChars); got != "\t" {
+			t.Fatalf("%s indented to %q", line, got)
+		}
+	}
+	E.cursorX = 1
+	editorInsertChar('}')
+	if got := string(E.rows[1].rawChars); got != "\t}" {
+		t.Fatalf("closing bracket in a comment dedented: %q", got)
+	}
+}
+
+func TestAutoPair(t *testing.T) {
+	newTestEditor("")
+	E.syntax = &HLDB[0]
+	E.autoPair = true
+	for _, c := range "f(\"a)\"" {
+		editorInsertChar(c)
+	}
+	if got := string(E.rows[0].rawChars); got != "f(\"a)\")" || E.cursorX != 6 {
+		t.Fatalf("unexpected row: %q, cx = %d", got, E.cursorX)
+	}
+	editorInsertChar(')')
+	if got := string(E.rows[0].rawChars); got != "f(\"a)\")" || E.cursorX != 7 {
+		t.Fatalf("closer not typed over: %q, cx = %d", got, E.cursorX)
+	}
+
+	newTestEditor("x // ")
+	E.syntax = &HLDB[0]
+	editorUpdateSyntax(E.rows[0])
+	E.autoPair = true
+	E.cursorX = 5
+	editorInsertChar('(')
+	if got := string(E.rows[0].rawChars); got != "x // (" {
+		t.Fatalf("paired inside a comment: %q", got)
+	}
+
+	newTestEditor("")
+	E.autoPair = true
+	editorInsertChar('[')
+	editorDelChar()
+	if E.rows[0].size != 0 {
+		t.Fatalf("empty pair not deleted: %q", string(E.rows[0].rawChars))
+	}
+}
+
+func TestMatchingBracket(t *testing.T) {
+	newTestEditor("f(a, \")\",", "\tg[1]) // (", "(")
+	E.syntax = &HLDB[0]
+	for _, erow := range E.rows {
+		editorUpdateSyntax(erow)
+	}
+	m, ok, _ := editorFindMatchingBracket(bracketPos{row: 0, cx: 1}, MAX_BRACKET_SCAN_ROWS)
+	if !ok || m.row != 1 || m.cx != 5 {
+		t.Fatalf("unexpected match: %+v, %v", m, ok)
+	}
+	m, ok, _ = editorFindMatchingBracket(m, MAX_BRACKET_SCAN_ROWS)
+	if !ok || m.row != 0 || m.cx != 1 {
+		t.Fatalf("unexpected match: %+v, %v", m, ok)
+	}
+	if _, ok, _ := editorFindMatchingBracket(bracketPos{row: 2, cx: 0}, MAX_BRACKET_SCAN_ROWS); ok {
+		t.Fatal("unbalanced bracket matched")
+	}
+
+	// an unmatched bracket doesn't highlight more rows per refresh than
+	// the screen does
+	lines := make([]string, 2*MAX_BRACKET_SCAN_ROWS)
+	for i := range lines {
+		lines[i] = "x;"
+	}
+	lines[0] = "{"
+	newTestEditor(lines...)
+	E.filename = "a.c"
+	editorSelectSyntaxHighlight()
+	editorHighlightScreen()
+	refreshes := 0
+	for hl := editorBracketHighlights(); hl == nil; hl = editorBracketHighlights() {
+		if E.hlValid > E.screenRows+(refreshes+1)*MAX_HL_ROWS_PER_FRAME {
+			t.Fatalf("%d rows highlighted in %d refreshes", E.hlValid, refreshes+1)
+		}
+		refreshes++
+	}
+	if hl := editorBracketHighlights(); len(hl) != 1 || hl[0].hl != HL_UNMATCHED_BRACKET || refreshes != 2 {
+		t.Fatalf("unexpected bracket highlights after %d refreshes: %+v", refreshes, hl)
+	}
+}
+
+func TestLazySyntax(t *testing.T) {
+	lines := make([]string, 100000)
+	for i := range lines {
+		lines[i] = "int x;"
+	}
+	newTestEditor(lines...)
+	E.filename = "a.c"
+	editorSelectSyntaxHighlight()
+	editorHighlightScreen()
+	if E.rows[0].hl[0] != HL_KEYWORD2 || E.rows[E.screenRows].hlDone {
+		t.Fatalf("unexpected highlighting: %v %v", E.rows[0].hl, E.rows[E.screenRows].hlDone)
+	}
+	// opening a comment at the top doesn't highlight the whole file
+	editorInsertRow(0, []rune("/*"))
+	editorHighlightScreen()
+	if E.rows[1].hl[0] != HL_MLCOMMENT || E.hlValid != E.screenRows {
+		t.Fatalf("unexpected highlighting: %v, valid to %d", E.rows[1].hl, E.hlValid)
+	}
+	// far away, the screen is highlighted over a few refreshes
+	E.rowOffset = 50000
+	refreshes := 0
+	for ; E.hlValid < E.rowOffset+E.screenRows; refreshes++ {
+		editorHighlightScreen()
+	}
+	if refreshes < 2 || E.rows[E.rowOffset].hl[0] != HL_MLCOMMENT {
+		t.Fatalf("unexpected highlighting after %d refreshes: %v", refreshes, E.rows[E.rowOffset].hl)
+	}
+	// closing it again
+	E.rowOffset = 0
+	editorInsertRow(1, []rune("*/"))
+	for E.hlValid < E.screenRows {
+		editorHighlightScreen()
+	}
+	if E.rows[2].hl[0] != HL_KEYWORD2 {
+		t.Fatalf("unexpected highlighting: %v", E.rows[2].hl)
+	}
+}
+
+func TestFindAllMatches(t *testing.T) {
+	newTestEditor("foo\tfoo", "bar", "你foo")
+	info := editorFindCallback("foo", 0)
+	if info != " [match 1 of 3]" || E.cursorY != 0 || E.cursorX != 0 {
+		t.Fatalf("unexpected state: %q (%d, %d)", info, E.cursorY, E.cursorX)
+	}
+	editorFindCallback("foo", tb.KeyArrowDown)
+	info = editorFindCallback("foo", tb.KeyArrowDown)
+	if info != " [match 3 of 3]" || E.cursorY != 2 || E.cursorX != 1 {
+		t.Fatalf("unexpected state: %q (%d, %d)", info, E.cursorY, E.cursorX)
+	}
+	E.rowOffset = 0
+	overlays := editorOverlays()
+	if len(overlays[0]) != 2 || overlays[0][1].start != 7 || overlays[2][0].hl != HL_MATCH {
+		t.Fatalf("unexpected overlays: %+v", overlays)
+	}
+	editorFindCallback("foo", tb.KeyEnter)
+	if len(editorOverlays()) != 0 {
+		t.Fatal("overlays left after the search")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	logger = log.New(io.Discard, "", 0)
+	state = editorState{History: map[string][]string{}}
+	for _, input := range []string{"foo", "bar", "foo", ""} {
+		editorAddHistory(HIST_SEARCH, input)
+	}
+	state = editorState{}
+	editorLoadState()
+	if got := state.History[HIST_SEARCH]; !slices.Equal(got, []string{"bar", "foo"}) {
+		t.Fatalf("unexpected history: %q", got)
+	}
+}
+
+func TestMinibuffer(t *testing.T) {
+	var mb minibuffer
+	mb.insert([]rune("你好 world\n"))
+	mb.handleKey(tb.Event{Key: tb.KeyBackspace2})
+	if mb.String() != "你好 worl" {
+		t.Fatalf("unexpected input: %q", mb.String())
+	}
+	mb.handleKey(tb.Event{Key: tb.KeyCtrlA})
+	mb.handleKey(tb.Event{Key: tb.KeyCtrlF})
+	mb.handleKey(tb.Event{Key: tb.KeyDelete})
+	if mb.String() != "你 worl" || mb.cursor != 1 {
+		t.Fatalf("unexpected input: %q, cursor = %d", mb.String(), mb.cursor)
+	}
+	mb.handleKey(tb.Event{Key: tb.KeyCtrlE})
+	mb.handleKey(tb.Event{Key: tb.KeyBackspace2, Mod: tb.ModAlt})
+	mb.handleKey(tb.Event{Key: tb.KeyCtrlA})
+	mb.handleKey(tb.Event{Key: tb.KeyCtrlY})
+	if mb.String() != "worl你 " || mb.cursor != 4 {
+		t.Fatalf("unexpected input: %q, cursor = %d", mb.String(), mb.cursor)
+	}
+}
+
+func TestCompletePath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"foo.c", "foobar.c", ".foo"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+
+	completed, candidates := completePath(dir + "/f")
+	if completed != dir+"/foo" || !slices.Equal(candidates, []string{"foo.c", "foobar.c"}) {
+		t.Fatalf("unexpected completion: %q, %q", completed, candidates)
+	}
+	completed, _ = completePath(dir + "/s")
+	if completed != dir+"/sub/" {
+		t.Fatalf("unexpected completion: %q", completed)
+	}
+	if completed, candidates = completePath(dir + "/x"); completed != dir+"/x" || candidates != nil {
+		t.Fatalf("unexpected completion: %q, %q", completed, candidates)
+	}
+}
+
+func TestDirectoryBuffer(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.c"), []byte("int x;\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	newTestEditor()
+	if err := editorOpen(dir); err != nil {
+		t.Fatal(err)
+	}
+	if E.numRows != 4 || len(E.dirEntries) != 3 || E.modified {
+		t.Fatalf("unexpected listing: %d rows, %+v", E.numRows, E.dirEntries)
+	}
+	if row := string(E.rows[3].rawChars); !strings.HasSuffix(row, " sub/") {
+		t.Fatalf("unexpected row: %q", row)
+	}
+
+	// M- keys don't edit the listing either
+	E.cursorY, E.cursorX = 3, 2
+	editorProcessMetaKey(0, 'd')
+	editorProcessMetaKey(tb.KeyBackspace2, 0)
+	if row := string(E.rows[3].rawChars); !strings.HasSuffix(row, " sub/") || E.modified {
+		t.Fatalf("listing edited: %q", row)
+	}
+
+	E.cursorY = 3
+	editorDiredProcessKey(tb.KeyEnter, 0)
+	if E.dirPath != filepath.Join(dir, "sub") || E.numRows != 2 {
+		t.Fatalf("didn't descend: %q, %d rows", E.dirPath, E.numRows)
+	}
+	editorDiredProcessKey(0, '^')
+	E.cursorY = 2
+	editorDiredProcessKey(tb.KeyEnter, 0)
+	if E.dirPath != "" || E.filename != filepath.Join(dir, "a.c") || string(E.rows[0].rawChars) != "int x;" {
+		t.Fatalf("didn't open the file: %q", E.filename)
+	}
+}
+
+func TestFuzzyFilter(t *testing.T) {
+	items := []string{"docs/kilo.md", "kilo.go", "vendor/k/i/l/o.go", "main.c"}
+	got := fuzzyFilter("kilo", items)
+	if !slices.Equal(got, []string{"kilo.go", "docs/kilo.md", "vendor/k/i/l/o.go"}) {
+		t.Fatalf("unexpected matches: %q", got)
+	}
+	if got := fuzzyFilter("Kilo", items); len(got) != 0 {
+		t.Fatalf("upper case query should be case sensitive: %q", got)
+	}
+}
+
+func TestFileWalker(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.go", "b.log", "keep.log", "build/out", "src/x.go", "src/gen/y.go", ".git/HEAD"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(root, name), nil, 0644)
+	}
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\n!keep.log\nbuild/\n"), 0644)
+	os.WriteFile(filepath.Join(root, "src", ".gitignore"), []byte("/gen\n"), 0644)
+
+	w := startFileWalker(root)
+	defer w.close()
+	var files []string
+	for done := false; !done; {
+		time.Sleep(time.Millisecond)
+		files, done = w.snapshot()
+	}
+	slices.Sort(files)
+	want := []string{".gitignore", "a.go", "keep.log", "src/.gitignore", "src/x.go"}
+	if !slices.Equal(files, want) {
+		t.Fatalf("unexpected files: %q", files)
+	}
+}
+
+func TestGrepFiles(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.go"), []byte("package a\n\nfunc 你好() {}\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.go"), []byte("func b() {}\n"), 0644)
+	os.WriteFile(filepath.Join(root, "bin"), []byte("func\x00"), 0644)
+	var searched atomic.Int64
+	res := grepFiles(root, regexp.MustCompile(`\(\)`), nil, &searched)
+	if len(res) != 2 || res[0].match.row != 2 || res[0].match.cx != 7 || res[1].line != "func b() {}" {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+	if searched.Load() != 3 {
+		t.Fatalf("%d files searched", searched.Load())
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if res := grepFiles(root, regexp.MustCompile(`\(\)`), stop, &searched); len(res) != 0 {
+		t.Fatalf("stopped search found %+v", res)
+	}
+}
+
+func TestRecentFiles(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	state = editorState{History: map[string][]string{}}
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("one\ntwo\nthree\n"), 0644)
+
+	newTestEditor()
+	buffers = []*editorConf{E}
+	editorVisitFile(path)
+	E.cursorY, E.cursorX = 2, 3
+	editorSaveSession()
+
+	state = editorState{}
+	editorLoadState()
+	if !slices.Equal(state.Session, []string{path}) || len(state.Recent) != 1 {
+		t.Fatalf("unexpected state: %+v", state)
+	}
+	newTestEditor()
+	buffers = []*editorConf{E}
+	editorRestoreSession()
+	if E.filename != path || E.cursorY != 2 || E.cursorX != 3 {
+		t.Fatalf("position not restored: %q (%d, %d)", E.filename, E.cursorY, E.cursorX)
+	}
+}
+
+func TestDiskChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("one\ntwo\n"), 0644)
+	newTestEditor()
+	buffers = []*editorConf{E}
+	editorOpen(path)
+	if editorDiskChanged(E) {
+		t.Fatal("changed right after opening")
+	}
+	editorWatchFiles()
+	if len(watchedFiles) != 1 || watchedFiles[0].name != path || !watchedFiles[0].disk.sameStat(E.disk) {
+		t.Fatalf("unexpected watched files: %+v", watchedFiles)
+	}
+	// same content, new mtime
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	if editorDiskChanged(E) {
+		t.Fatal("a touched file counted as changed")
+	}
+	os.WriteFile(path, []byte("one\n2\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Hour))
+	if !editorDiskChanged(E) {
+		t.Fatal("change not detected")
+	}
+	E.cursorY = 1
+	editorCheckDisk()
+	if string(E.rows[1].rawChars) != "2" || E.cursorY != 1 || editorDiskChanged(E) {
+		t.Fatalf("not reverted: %q", string(E.rows[1].rawChars))
+	}
+}
+
+func TestPieceTable(t *testing.T) {
+	var lines []string
+	var content strings.Builder
+	for i := 0; i < 20000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+		content.WriteString(lines[i] + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte(content.String()), 0644)
+	f, _ := os.Open(path)
+	defer f.Close()
+	pt, err := newPieceTable(f, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 2000; n++ {
+		i := rnd.Intn(len(lines))
+		switch rnd.Intn(3) {
+		case 0:
+			lines = slices.Insert(lines, i, fmt.Sprintf("new %d", n))
+			pt.insertLine(i, []byte(lines[i]))
+		case 1:
+			lines = slices.Delete(lines, i, i+1)
+			pt.deleteLine(i)
+		case 2:
+			lines[i] += "x"
+			pt.setLine(i, []byte(lines[i]))
+		}
+		if i < len(lines) && string(pt.line(i)) != lines[i] {
+			t.Fatalf("op %d: line %d is %q, want %q", n, i, pt.line(i), lines[i])
+		}
+	}
+	if pt.lineCount() != len(lines) {
+		t.Fatalf("%d lines, want %d", pt.lineCount(), len(lines))
+	}
+	var out bytes.Buffer
+	pt.WriteTo(&out)
+	if want := strings.Join(lines, "\n") + "\n"; out.String() != want {
+		t.Fatal("content differs after edits")
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "a.log")
+	os.WriteFile(path, []byte("one\r\ntwo\nthree"), 0644)
+	newTestEditor()
+	buffers = []*editorConf{E}
+	if err := editorOpenLarge(path); err != nil {
+		t.Fatal(err)
+	}
+	if E.numRows != 3 || string(E.row(0).rawChars) != "one" || string(E.row(2).rawChars) != "three" {
+		t.Fatalf("unexpected rows: %d", E.numRows)
+	}
+	E.cursorY, E.cursorX = 1, 3
+	editorInsertNewline()
+	editorInsertText([]rune("2"))
+	E.cursorY, E.cursorX = 0, 0
+	editorDelChar()
+	E.cursorX = 3
+	editorInsertChar('!')
+	if E.numRows != 4 || string(E.row(2).rawChars) != "2" {
+		t.Fatalf("unexpected rows after edits: %d %q", E.numRows, string(E.row(2).rawChars))
+	}
+	if m := editorFindAll([]rune("hre")); len(m) != 1 || m[0] != (searchMatch{3, 1}) {
+		t.Fatalf("unexpected matches: %v", m)
+	}
+	editorSave()
+	data, _ := os.ReadFile(path)
+	// edited lines keep their endings, new ones end like the first
+	if string(data) != "one!\r\ntwo\n2\r\nthree\r\n" || E.modified || editorDiskChanged(E) {
+		t.Fatalf("unexpected save: %q", data)
+	}
+	// the buffer still reads the file it opened
+	E.rowCache = make(map[int]*editorRow)
+	if string(E.row(0).rawChars) != "one!" {
+		t.Fatalf("unexpected row after save: %q", string(E.row(0).rawChars))
+	}
+
+	// a log that grows isn't reloaded
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("four\n")
+	f.Close()
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	editorCheckDisk()
+	if E.numRows != 4 || !strings.Contains(E.statusMsg, "changed on disk") {
+		t.Fatalf("large file reloaded: %d rows, %q", E.numRows, E.statusMsg)
+	}
+}
+
+var largeFileSize = flag.Int64("largefile.size", 1<<30, "size of the file for the large file benchmarks")
+
+// largeTestFile is the file of the large file benchmarks, written once
+// per run and removed by TestMain
+var largeTestFile struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if largeTestFile.dir != "" {
+		os.RemoveAll(largeTestFile.dir)
+	}
+	os.Exit(code)
+}
+
+// openLargeTestFile opens a file of -largefile.size bytes, written once
+// to a temp dir and reused by the other benchmarks
+func openLargeTestFile(b *testing.B) string {
+	b.Setenv("XDG_STATE_HOME", b.TempDir())
+	largeTestFile.once.Do(func() {
+		largeTestFile.dir, largeTestFile.err = os.MkdirTemp("", "gkilo-bench-")
+		if largeTestFile.err == nil {
+			largeTestFile.err = writeLargeTestFile(filepath.Join(largeTestFile.dir, "a.log"))
+		}
+	})
+	if largeTestFile.err != nil {
+		b.Fatal(largeTestFile.err)
+	}
+	path := filepath.Join(largeTestFile.dir, "a.log")
+	newTestEditor()
+	buffers = []*editorConf{E}
+	if err := editorOpenLarge(path); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// writeLargeTestFile writes -largefile.size bytes of log lines
+func writeLargeTestFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for n, i := int64(0), 0; n < *largeFileSize; i++ {
+		line := fmt.Sprintf("%d 2026-01-02T15:04:05Z INFO request served in %dms\n", i, i%997)
+		if n+int64(len(line)) > *largeFileSize {
+			line = line[:*largeFileSize-n]
+		}
+		w.WriteString(line)
+		n += int64(len(line))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func BenchmarkLargeFileOpen(b *testing.B) {
+	path := openLargeTestFile(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		editorResetBuffer()
+		if err := editorOpenLarge(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLargeFileScroll(b *testing.B) {
+	openLargeTestFile(b)
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a page of rows somewhere in the file, as a refresh reads them
+		E.rowOffset = rnd.Intn(E.numRows - E.screenRows)
+		for y := E.rowOffset; y < E.rowOffset+E.screenRows; y++ {
+			E.row(y)
+		}
+		editorTrimRowCache()
+	}
+}
+
+func BenchmarkLargeFileEdit(b *testing.B) {
+	openLargeTestFile(b)
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		E.cursorY, E.cursorX = rnd.Intn(E.numRows), 0
+		editorInsertChar('x')
+		editorInsertNewline()
+		editorDelChar()
+		editorTrimRowCache()
+	}
+}
+
+func TestDrawChangedRows(t *testing.T) {
+	newTestEditor("one", "two", "three")
+	drawnRows = nil
+	if n := editorDrawRows(); n != E.screenRows {
+		t.Fatalf("first refresh drew %d rows", n)
+	}
+	if n := editorDrawRows(); n != 0 {
+		t.Fatalf("refresh without changes drew %d rows", n)
+	}
+	E.cursorY, E.cursorX = 1, 3
+	editorInsertChar('!')
+	if n := editorDrawRows(); n != 1 {
+		t.Fatalf("refresh after typing drew %d rows", n)
+	}
+	// a row that moved keeps its cells
+	cells := drawnRows[1].cells
+	editorInsertRow(0, []rune("zero"))
+	editorDrawRows()
+	if &drawnRows[2].cells[0] != &cells[0] || drawnRows[2].cells[3].Ch != '!' {
+		t.Fatal("moved row rendered again")
+	}
+	editorDamageRows(0, 1)
+	if n := editorDrawRows(); n != 1 {
+		t.Fatalf("refresh after damage drew %d rows", n)
+	}
+}
+
+// benchmarkKeystroke measures typing and deleting a character in the
+// middle of the screen, and the refreshes after them
+func benchmarkKeystroke(b *testing.B, rows, cols, lineLen int) {
+	line := strings.Repeat("int x = 42; /* a comment */ ", lineLen/28+1)[:lineLen]
+	lines := make([]string, 2*rows)
+	for i := range lines {
+		lines[i] = line
+	}
+	newTestEditor(lines...)
+	E.screenRows, E.screenCols = rows, cols
+	E.statusBarRowIdx, E.msgBarRowIdx = rows, rows+1
+	E.filename = "a.c"
+	editorSelectSyntaxHighlight()
+	E.cursorY, E.cursorX = rows/2, lineLen/2
+	drawnRows = nil
+	editorDrawScreen()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		editorInsertChar('x')
+		editorDrawScreen()
+		editorDelChar()
+		editorDrawScreen()
+	}
+}
+
+func BenchmarkKeystrokeLongLine(b *testing.B) {
+	benchmarkKeystroke(b, 24, 80, 100000)
+}
+
+func BenchmarkKeystrokeLargeScreen(b *testing.B) {
+	benchmarkKeystroke(b, 100, 400, 300)
+}
+
+func TestReadOnly(t *testing.T) {
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprint(i)
+	}
+	newTestEditor(lines...)
+	E.modified = false
+	E.readOnly = true
+	E.cursorX = 1
+	editorInsertChar('x')
+	editorDelChar()
+	editorInsertNewline()
+	editorInsertText([]rune("a\nb"))
+	editorInsertRow(0, []rune("zero"))
+	editorDelRow(1)
+	if E.numRows != 50 || string(E.rows[0].rawChars) != "0" || E.modified || !strings.Contains(E.statusMsg, "read-only") {
+		t.Fatalf("read-only buffer edited: %d rows, %q", E.numRows, string(E.rows[0].rawChars))
+	}
+	if !editorViewProcessKey(tb.KeySpace, 0) || E.cursorY != 39 {
+		t.Fatalf("SPC moved to row %d", E.cursorY)
+	}
+	if !editorViewProcessKey(0, 'g') || E.cursorY != 0 || editorViewProcessKey(0, 'x') {
+		t.Fatalf("g moved to row %d", E.cursorY)
+	}
+	editorToggleReadOnly()
+	editorInsertChar('x')
+	if string(E.rows[0].rawChars) != "x0" {
+		t.Fatalf("writable buffer not edited: %q", string(E.rows[0].rawChars))
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root may write to any file")
+	}
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("one\n"), 0444)
+	newTestEditor()
+	buffers = []*editorConf{E}
+	editorOpen(path)
+	if !E.readOnly {
+		t.Fatal("file without write permission opened writable")
+	}
+}
+
+func TestSaveWithHelper(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	newTestEditor("one", "two")
+	E.filename = path
+	defer func() {
+		saveHelper = ""
+	}()
+	saveHelper = "tee"
+	editorSaveWithHelper(editorRowsToBytes())
+	if data, _ := os.ReadFile(path); string(data) != "one\ntwo\n" || E.modified {
+		t.Fatalf("unexpected save: %q, %q", data, E.statusMsg)
+	}
+	// a helper that doesn't write what it's given
+	script := filepath.Join(dir, "bad-tee")
+	os.WriteFile(script, []byte("#!/bin/sh\ncat >/dev/null\necho wrong >\"$1\"\n"), 0755)
+	saveHelper = script
+	E.modified = true
+	editorSaveWithHelper(editorRowsToBytes())
+	if !E.modified || !strings.Contains(E.statusMsg, "differs") {
+		t.Fatalf("bad save not detected: %q", E.statusMsg)
+	}
+}
+
+func TestHelperPrompts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("no pseudo terminals")
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	cmd := exec.Command("sh", "-c", "printf 'Password: ' >/dev/tty; read pw </dev/tty; echo \"$pw\" >"+out)
+	tty, err := startWithPty(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	prompts := make(chan string)
+	finished := make(chan struct{})
+	defer close(finished)
+	go helperPrompts(tty, prompts, finished)
+	select {
+	case prompt := <-prompts:
+		if prompt != "Password:" {
+			t.Fatalf("unexpected prompt: %q", prompt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no prompt")
+	}
+	tty.WriteString("secret\n")
+	cmd.Wait()
+	if data, _ := os.ReadFile(out); string(data) != "secret\n" {
+		t.Fatalf("unexpected answer: %q", data)
+	}
+}
+
+func TestCompressedFiles(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	for _, c := range COMPRESSIONS {
+		if c.name == "zstd" {
+			if _, err := exec.LookPath("zstd"); err != nil {
+				t.Log("no zstd command")
+				continue
+			}
+		}
+		path := filepath.Join(t.TempDir(), "a.log")
+		data, err := c.compress([]byte("one\ntwo\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(path, data, 0644)
+		newTestEditor()
+		buffers = []*editorConf{E}
+		if err := editorOpen(path); err != nil {
+			t.Fatal(err)
+		}
+		if E.compression != c || E.numRows != 2 || string(E.rows[1].rawChars) != "two" {
+			t.Fatalf("%s: unexpected rows: %d", c.name, E.numRows)
+		}
+		E.cursorY, E.cursorX = 1, 3
+		editorInsertChar('!')
+		editorSave()
+		data, _ = os.ReadFile(path)
+		if sniffCompression(path) != c {
+			t.Fatalf("%s: saved uncompressed: %q", c.name, data)
+		}
+		if data, _ = c.decompress(data); string(data) != "one\ntwo!\n" || editorDiskChanged(E) {
+			t.Fatalf("%s: unexpected save: %q", c.name, data)
+		}
+	}
+}
+
+func TestHexMode(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	if isBinary([]byte("plain text\n")) || isBinary([]byte("\xc4\xe3\xba\xc3 gbk\n")) || !isBinary([]byte("ELF\x00\x01")) {
+		t.Fatal("wrong binary detection")
+	}
+	data := make([]byte, 20)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	copy(data[16:], "AB\r\n")
+	path := filepath.Join(t.TempDir(), "a.bin")
+	os.WriteFile(path, data, 0644)
+	newTestEditor()
+	buffers = []*editorConf{E}
+	if err := editorOpen(path); err != nil {
+		t.Fatal(err)
+	}
+	// a large binary file isn't opened as large text
+	large := filepath.Join(t.TempDir(), "large.bin")
+	os.WriteFile(large, []byte("ELF\x00"), 0644)
+	os.Truncate(large, LARGE_FILE_SIZE)
+	if err := editorOpen(large); err == nil || E.pieces != nil || E.filename != path {
+		t.Fatalf("large binary file opened: %v", err)
+	}
+	want := "00000000  00 0d 1a 27 34 41 4e 5b  68 75 82 8f 9c a9 b6 c3  |...'4AN[hu......|"
+	if !E.hexMode || E.numRows != 2 || string(E.rows[0].rawChars) != want {
+		t.Fatalf("unexpected hex dump: %q", string(E.rows[0].rawChars))
+	}
+	if string(E.rows[1].rawChars[HEX_ASCII_COL-1:]) != "|AB..|" {
+		t.Fatalf("unexpected last row: %q", string(E.rows[1].rawChars))
+	}
+
+	// nibbles, then the ASCII column
+	editorHexSetCursor(9, 0, false)
+	for _, ch := range "fF" {
+		editorHexProcessKey(0, ch)
+	}
+	if off, nibble, ascii := editorHexCursor(); E.hexData[9] != 0xff || off != 10 || nibble != 0 || ascii {
+		t.Fatalf("unexpected nibble edit: %x at %d", E.hexData[9], off)
+	}
+	editorHexProcessKey(tb.KeyTab, 0)
+	editorHexProcessKey(0, 'z')
+	if E.hexData[10] != 'z' || E.rows[0].rawChars[HEX_ASCII_COL+10] != 'z' {
+		t.Fatalf("unexpected ASCII edit: %x", E.hexData[10])
+	}
+	editorInsertNewline()
+	editorDelChar()
+	if E.numRows != 2 || !strings.Contains(E.statusMsg, "overwritten") {
+		t.Fatalf("hex buffer reshaped: %d rows", E.numRows)
+	}
+	editorSave()
+	if saved, _ := os.ReadFile(path); !bytes.Equal(saved, E.hexData) || saved[9] != 0xff {
+		t.Fatalf("unexpected save: %q", saved)
+	}
+
+	for query, want := range map[string]string{`de ad BEEF`: "\xde\xad\xbe\xef", `"a b"`: "a b", `0`: ""} {
+		got, err := parseHexQuery(query)
+		if string(got) != want || (err == nil) != (want != "") {
+			t.Fatalf("%s parsed to %q, %v", query, got, err)
+		}
+	}
+}
+
+func TestShellCommands(t *testing.T) {
+	t.Setenv("SHELL", "/bin/sh")
+	ctx := context.Background()
+	if out, err := shellCommand(ctx, "sort", "", []byte("b\na\n")); err != nil || string(out) != "a\nb\n" {
+		t.Fatalf("sort gave %q, %v", out, err)
+	}
+	if _, err := shellCommand(ctx, "echo oops >&2; exit 3", "", nil); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("failure without stderr: %v", err)
+	}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := shellCommand(short, "sleep 5", "", nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("sleep not timed out: %v", err)
+	}
+
+	// the whole buffer
+	newTestEditor("c", "a", "b")
+	y1, x1, y2, x2 := editorRegion()
+	input := string(editorRegionText(y1, x1, y2, x2)) + "\n"
+	out, _ := shellCommand(ctx, "sort", "", []byte(input))
+	editorReplaceRegion(y1, x1, y2, x2, editorFilterOutput(input, string(out)))
+	if E.numRows != 3 || string(E.rows[0].rawChars) != "a" || string(E.rows[2].rawChars) != "c" {
+		t.Fatalf("unexpected filtered buffer: %d rows", E.numRows)
+	}
+
+	// a region inside rows
+	newTestEditor("one two", "three four")
+	E.cursorY, E.cursorX = 1, 5
+	editorSetMark()
+	E.cursorY, E.cursorX = 0, 4
+	y1, x1, y2, x2 = editorRegion()
+	input = string(editorRegionText(y1, x1, y2, x2))
+	if input != "two\nthree" {
+		t.Fatalf("unexpected region: %q", input)
+	}
+	out, _ = shellCommand(ctx, "tr a-z A-Z", "", []byte(input))
+	editorReplaceRegion(y1, x1, y2, x2, editorFilterOutput(input, string(out)))
+	if E.numRows != 2 || string(E.rows[0].rawChars) != "one TWO" || string(E.rows[1].rawChars) != "THREE four" {
+		t.Fatalf("unexpected filtered region: %q", string(E.rows[1].rawChars))
+	}
+
+	// listings aren't filtered
+	newTestEditor()
+	if err := editorOpen(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	header := string(E.rows[0].rawChars)
+	y1, x1, y2, x2 = editorRegion()
+	editorReplaceRegion(y1, x1, y2, x2, []rune("sorted"))
+	if string(E.rows[0].rawChars) != header || !strings.Contains(E.statusMsg, "listing") {
+		t.Fatalf("listing filtered: %q", string(E.rows[0].rawChars))
+	}
+
+	// nor the whole of a large file
+	path := filepath.Join(t.TempDir(), "a.log")
+	os.WriteFile(path, []byte("b\na\n"), 0644)
+	newTestEditor()
+	if err := editorOpenLarge(path); err != nil {
+		t.Fatal(err)
+	}
+	editorFilterRegion()
+	if E.modified || !strings.Contains(E.statusMsg, "set the mark") {
+		t.Fatalf("large file filtered: %q", E.statusMsg)
+	}
+}
+
+func TestFormatOnSave(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("SHELL", "/bin/sh")
+	path := filepath.Join(t.TempDir(), "a.txt")
+	newTestEditor("a  =  1", "", "", "b  =  2")
+	buffers = []*editorConf{E}
+	E.filename = path
+	E.syntax = &editorSyntax{fileType: "text", formatter: `sed 's/  */ /g' | cat -s`}
+	E.cursorY, E.cursorX = 3, 5
+	editorSave()
+	if data, _ := os.ReadFile(path); string(data) != "a = 1\n\nb = 2\n" {
+		t.Fatalf("unexpected formatted save: %q", data)
+	}
+	// still after "b ="
+	if E.cursorY != 2 || E.cursorX != 3 || E.modified {
+		t.Fatalf("cursor moved to %d:%d", E.cursorY, E.cursorX)
+	}
+
+	E.syntax.formatter = `echo "<standard input>:3:7: expected ';'" >&2; exit 2`
+	editorInsertChar('!')
+	editorSave()
+	if data, _ := os.ReadFile(path); string(data) != "a = 1\n\nb =! 2\n" || !strings.Contains(E.statusMsg, "line 3: expected ';'") {
+		t.Fatalf("unexpected save with a failing formatter: %q, %q", data, E.statusMsg)
+	}
+
+	// no output isn't taken as an empty file
+	E.syntax.formatter = `cat >/dev/null`
+	editorInsertChar('!')
+	editorSave()
+	if data, _ := os.ReadFile(path); string(data) != "a = 1\n\nb =!! 2\n" || E.numRows != 3 || !strings.Contains(E.statusMsg, "no output") {
+		t.Fatalf("unexpected save with an empty output: %q, %q", data, E.statusMsg)
+	}
+}
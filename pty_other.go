@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// HAVE_PTY tells if startWithPty can give cmd a terminal of its own
+const HAVE_PTY = false
+
+// startWithPty refuses to start cmd, pseudo terminals are only
+// supported on linux. Started in our own terminal, cmd would fight
+// termbox over it, eg, to ask a password.
+func startWithPty(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("pseudo terminals are only supported on linux")
+}
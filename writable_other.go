@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileWritable reports whether we may write to the file name, going by
+// its mode bits, access(2) is only available on unix
+func fileWritable(name string) bool {
+	fi, err := os.Stat(name)
+	return err != nil || fi.Mode().Perm()&0200 != 0
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// W_OK asks access(2) about write permission
+const W_OK = 0x2
+
+// fileWritable reports whether we may write to the file name, without
+// opening it, which could block on a FIFO or a device. Only a lack of
+// permission counts, other errors show up on save.
+func fileWritable(name string) bool {
+	err := syscall.Access(name, W_OK)
+	return err == nil || !(os.IsPermission(err) || err == syscall.EROFS)
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileWritableFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Skip(err)
+	}
+	// opening a FIFO to write blocks until someone reads it
+	if !fileWritable(path) {
+		t.Fatal("FIFO not writable")
+	}
+}